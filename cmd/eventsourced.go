@@ -3,9 +3,11 @@
 package main
 
 import (
+	"errors"
 	_ "expvar"
 	"fmt"
 	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -14,6 +16,7 @@ import (
 
 	"eventsourced/intern/app"
 	"eventsourced/intern/conf"
+	"eventsourced/intern/logging"
 	"eventsourced/intern/metric"
 )
 
@@ -32,32 +35,83 @@ func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 	log.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
 
+	// Precedence from low to high: defaults, config files, environment
+	// variables, flags.
+	opt := app.NewGetOpt()
+	config := loadConfig(opt.ConfigFile())
+	if opt.ConfigFile() != "" && !config.Loaded() && config.Err() == nil {
+		log.Fatalf("config: %s not loaded", opt.ConfigFile())
+	}
+	env, envErr := config.Override(os.LookupEnv)
+	flags := opt.Override(&config)
+
 	var (
 		version = app.NewVersion(project, version, commit, status)
-		config  = loadConfig()
 		state   = app.NewState(version, config)
 		metrics = metric.NewMetric(project).Publish()
 	)
 
-	if !app.NewGetOpt().Complement(state) {
-		return
+	if !opt.Complement(state) {
+		os.Exit(opt.ExitCode())
+	}
+	if err := app.Validate(config); err != nil {
+		log.Fatalf("config: invalid, %s", strings.ReplaceAll(err.Error(), "\n", "; "))
 	}
 
+	logger, err := logging.NewLogger(os.Stderr, config.Log)
+	if err != nil {
+		log.Printf("%s, using default preset", err)
+		logger, _ = logging.NewLogger(os.Stderr, conf.Log{})
+	}
+	logger = logger.With("pid", os.Getpid())
+	slog.SetDefault(logger)
+
 	if config.Loaded() {
 		configs := strings.Join(config.Source()[:], ", ")
-		log.Printf("config: loaded %s", configs)
+		logger.Info("config: loaded", "source", configs)
 	} else {
-		log.Print("config: not loaded, using default preset")
+		logger.Warn("config: not loaded, using default preset")
+	}
+	if len(env) > 0 || len(flags) > 0 {
+		logger.Info("config: overridden", "env", strings.Join(env, ", "), "flags", strings.Join(flags, ", "))
+	}
+	if envErr != nil {
+		logger.Warn("config: invalid override", "error", envErr)
 	}
 
-	_ = app.NewFactory(state, metrics).Server().Launch()
+	factory := app.NewFactory(state, metrics, logger)
+	stopReload := app.ReloadOnHangup(state, func() (conf.Config, error) {
+		return reloadConfig(opt)
+	}, logger)
+	_ = factory.Server().Launch()
+	stopReload()
+	_ = factory.Close()
 }
 
-func loadConfig() conf.Config {
+// reloadConfig reads and overrides the configuration as on start. It is
+// not applied without a file loaded, the defaults would replace it.
+func reloadConfig(opt app.GetOpt) (conf.Config, error) {
+	config := loadConfig(opt.ConfigFile())
+	if !config.Loaded() && config.Err() == nil {
+		return config, errors.New("no configuration file loaded")
+	}
+	_, _ = config.Override(os.LookupEnv)
+	opt.Override(&config)
+
+	return config, app.Validate(config)
+}
+
+// loadConfig reads the given file only, else the one in /etc and the one
+// next to the executable, the latter taking precedence.
+func loadConfig(file string) conf.Config {
 	var selfFile string
 	var confPath string
 	var err error
 
+	if file != "" {
+		return conf.NewConfig(file)
+	}
+
 	if selfFile, err = os.Executable(); err != nil {
 		panic(err)
 	}
@@ -3,48 +3,181 @@
 package app
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
 	"eventsourced/intern/broker"
 	"eventsourced/intern/conf"
 	"eventsourced/intern/event"
 	"eventsourced/intern/metric"
 	"eventsourced/intern/serv"
+	"eventsourced/intern/tracing"
+)
+
+// connectTimeout is the default wait of a request for a broker connection.
+const connectTimeout = 5 * time.Second
 
-	"github.com/streadway/amqp"
+var (
+	errNoBroker   = errors.New("no broker node connected")
+	errAdminToken = errors.New("admin: disabled, token missing")
 )
 
 type (
 	// Factory resolves dependencies.
 	Factory interface {
 		Server() serv.Server
+		Close() error
 	}
 	factory struct {
-		state  State
-		metric metric.Metric
-		brConn <-chan broker.Connection
+		state    State
+		metric   metric.Metric
+		brokers  broker.Connector
+		brConn   <-chan broker.Connection
+		limiter  serv.Limiter
+		registry serv.Registry
+		presence serv.Presence
+		webhook  serv.Webhook
+		confirm  serv.Confirmation
+		group    serv.Group
+		tracing  tracing.Provider
+		logger   *slog.Logger
+		drain    chan struct{}
+		once     sync.Once
+		// connectTimeout bounds the wait of a request for a broker
+		// connection, zero waits indefinitely.
+		connectTimeout time.Duration
+		// confirmTimeout is read on start along with confirm, as a
+		// reloaded zero timeout would redeliver right away.
+		confirmTimeout time.Duration
 	}
 )
 
-// NewFactory creates a new Factory form given State.
-func NewFactory(state State, metric metric.Metric) Factory {
-	return &factory{
-		state:  state,
-		metric: metric,
-		brConn: yieldConn(state.Config(), metric),
+// NewFactory creates a new Factory form given State, which logs to the
+// given logger.
+func NewFactory(state State, metric metric.Metric, logger *slog.Logger) Factory {
+	f := &factory{
+		state:   state,
+		metric:  metric,
+		brokers: newConnector(state.Config(), metric, logger),
+		limiter: serv.NewLimiter(state.Config().Server.MaxStreams),
+		drain:   make(chan struct{}),
+		tracing: tracing.NewNoopProvider(),
+		logger:  logger,
+
+		connectTimeout: connectTimeout,
+	}
+	f.brConn = f.brokers.Connection()
+	state.Subscribe(f.reconfigure)
+	if state.Config().Queue.Confirm > 0 {
+		f.confirm = serv.NewConfirmation()
+		f.confirmTimeout = time.Duration(state.Config().Queue.Confirm) * time.Second
+	}
+	if state.Config().Admin.Address != "" {
+		f.registry = serv.NewRegistry()
+	}
+	if presence := state.Config().Presence; presence.Exchange != "" {
+		f.presence = serv.NewPresence(f.brConn, presence.Exchange, instance(presence.Instance), logger)
+	}
+	if webhook := state.Config().Webhook; webhook.Authorize != "" || webhook.Closed != "" {
+		f.webhook = serv.NewWebhook(serv.WebhookOptions{
+			Authorize: webhook.Authorize,
+			Closed:    webhook.Closed,
+			Secret:    webhook.Secret,
+			Timeout:   time.Duration(webhook.Timeout) * time.Second,
+			Retries:   webhook.Retries,
+			Instance:  instance(state.Config().Presence.Instance),
+			Logger:    logger,
+		})
+	}
+	if group, err := serv.NewGroup(state.Config().Queue.Group); err != nil {
+		logger.Error("queue group: invalid expression", "error", err)
+	} else {
+		f.group = group
+	}
+	if provider, err := tracing.NewProvider(state.Config().Tracing, state.Version().Short()); err != nil {
+		logger.Error("tracing: disabled", "error", err)
+	} else {
+		f.tracing = provider
+	}
+	return f
+}
+
+// reconfigure applies an updated configuration. Requests read it on
+// arrival, open streams keep the one they started with. Changed broker
+// nodes are reconciled, entries read on start only are logged to take
+// effect on restart.
+func (f *factory) reconfigure(old, config conf.Config) {
+	if !reflect.DeepEqual(old.Broker.Node, config.Broker.Node) && old.Broker.Type == config.Broker.Type {
+		drain := time.Duration(config.Server.Drain) * time.Second
+		f.brokers.Reconcile(brokerURLs(config, f.logger), drain)
+	}
+
+	var restart []string
+	for _, entry := range []struct {
+		name       string
+		old, value interface{}
+	}{
+		{"server.address", old.Server.Address, config.Server.Address},
+		{"server.max_streams", old.Server.MaxStreams, config.Server.MaxStreams},
+		{"broker.type", old.Broker.Type, config.Broker.Type},
+		{"queue.confirm", old.Queue.Confirm, config.Queue.Confirm},
+		{"queue.group", old.Queue.Group, config.Queue.Group},
+		{"tracing", old.Tracing, config.Tracing},
+		{"log.level", old.Log.Level, config.Log.Level},
+		{"log.format", old.Log.Format, config.Log.Format},
+		{"admin", old.Admin, config.Admin},
+		{"presence.exchange", old.Presence.Exchange, config.Presence.Exchange},
+		{"presence.instance", old.Presence.Instance, config.Presence.Instance},
+		{"webhook", old.Webhook, config.Webhook},
+	} {
+		if !reflect.DeepEqual(entry.old, entry.value) {
+			restart = append(restart, entry.name)
+		}
+	}
+	if len(restart) > 0 {
+		f.logger.Warn("config: restart required", "entries", strings.Join(restart, ", "))
 	}
 }
 
 // Server ...
 func (f *factory) Server() serv.Server {
-	return serv.NewServer(
-		&http.Server{
-			Addr:    f.state.Config().Server.Address,
-			Handler: f.serveMuxer(),
-		},
-	)
+	config := f.state.Config()
+
+	srv := &http.Server{
+		Addr:    config.Server.Address,
+		Handler: f.serveMuxer(),
+	}
+	srv.RegisterOnShutdown(func() {
+		f.once.Do(func() { close(f.drain) })
+	})
+
+	if admin := f.adminServer(); admin != nil {
+		srv.RegisterOnShutdown(func() { _ = admin.Shutdown() })
+		go func() { _ = admin.Launch() }()
+	}
+
+	return serv.NewServer(srv, time.Duration(config.Server.Drain)*time.Second, f.logger)
+}
+
+// Close publishes the pending presence events, calls the webhook for the
+// streams closed and exports the remaining spans, call it after the server
+// stopped.
+func (f *factory) Close() error {
+	if f.presence != nil {
+		_ = f.presence.Close()
+	}
+	if f.webhook != nil {
+		_ = f.webhook.Close()
+	}
+	return f.tracing.Shutdown()
 }
 
 func (f *factory) serveMuxer() *http.ServeMux {
@@ -52,6 +185,47 @@ func (f *factory) serveMuxer() *http.ServeMux {
 
 	muxer.HandleFunc("/", f.endpoint)
 	muxer.Handle("/debug/vars", http.DefaultServeMux)
+	muxer.HandleFunc("/metrics", f.prometheus)
+	muxer.HandleFunc("/healthz", serv.NewHealthHandler().Handle)
+	muxer.HandleFunc("/readyz", serv.NewHealthHandler(f.readiness()...).Handle)
+
+	if f.confirm != nil {
+		muxer.HandleFunc("/ack", f.confirmation)
+	}
+
+	return muxer
+}
+
+// adminServer serves the admin API on its own address, nil when disabled.
+func (f *factory) adminServer() serv.Server {
+	config := f.state.Config()
+
+	if f.registry == nil {
+		return nil
+	}
+	if config.Admin.Token == "" {
+		f.logger.Error(errAdminToken.Error())
+		return nil
+	}
+
+	srv := &http.Server{
+		Addr:    config.Admin.Address,
+		Handler: f.adminMuxer(),
+	}
+	return serv.NewAdminServer(srv, f.logger)
+}
+
+func (f *factory) adminMuxer() *http.ServeMux {
+	muxer := http.NewServeMux()
+	config := f.state.Config()
+	token := config.Admin.Token
+
+	streams := serv.NewAuthHandler(token, serv.NewStreamsHandler(f.registry))
+	muxer.HandleFunc("/admin/streams", streams.Handle)
+	muxer.HandleFunc("/admin/streams/", streams.Handle)
+
+	queues := serv.NewAuthHandler(token, serv.NewQueuesHandler(f.brConn, config.Queue.Expires))
+	muxer.HandleFunc("/admin/queues/", queues.Handle)
 
 	return muxer
 }
@@ -60,9 +234,29 @@ func (f *factory) endpoint(w http.ResponseWriter, r *http.Request) {
 	config := f.state.Config()
 	pattern := serv.NewPattern(config.Queue.Pattern)
 	expires := config.Queue.Expires
+	prefetch := config.Queue.Prefetch
 
 	producer := event.NewProducer()
-	consumer := serv.NewConsumer(<-f.brConn, expires)
+	var conn broker.Connection
+	var timeout <-chan time.Time
+	if f.connectTimeout > 0 {
+		timer := time.NewTimer(f.connectTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case conn = <-f.brConn:
+	case <-timeout:
+		for k, v := range config.Header.CORS {
+			w.Header().Set(k, v)
+		}
+		w.Header().Set("X-Status-Reason", errNoBroker.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		f.metric.IncRequestCount(http.StatusServiceUnavailable)
+		f.logger.Warn("server: request failed", "status", http.StatusServiceUnavailable, "error", errNoBroker)
+		return
+	}
+	consumer := serv.NewConsumer(conn, expires, prefetch)
 	defer func() { _ = consumer.Close() }()
 
 	serv.NewServerSentHandler(
@@ -74,19 +268,102 @@ func (f *factory) endpoint(w http.ResponseWriter, r *http.Request) {
 			SSE:  config.Header.SSE,
 		},
 		f.metric,
+		&serv.StreamOptions{
+			Confirm:         f.confirm,
+			ConfirmTimeout:  f.confirmTimeout,
+			Prefetch:        prefetch,
+			Redeliver:       config.Queue.Redeliver,
+			Heartbeat:       time.Duration(config.Server.Heartbeat) * time.Second,
+			WriteTimeout:    time.Duration(config.Server.WriteTimeout) * time.Second,
+			MaxIdle:         time.Duration(config.Server.MaxIdle) * time.Second,
+			Retry:           time.Duration(config.Server.Retry) * time.Second,
+			MinThroughput:   config.Server.MinThroughput,
+			SlowPolicy:      config.Server.SlowPolicy,
+			Drain:           f.drain,
+			RetryJitter:     time.Duration(config.Server.RetryJitter) * time.Second,
+			Node:            broker.Node(conn),
+			Group:           f.group,
+			TimestampHeader: config.Queue.Latency.Header,
+			StampLatency:    config.Queue.Latency.Comment,
+			Tracer:          f.tracing.Tracer(),
+			Logger:          f.logger,
+			LogMessages:     config.Log.Messages,
+			Limiter:         f.limiter,
+			Registry:        f.registry,
+			Presence:        f.presence,
+			Claims:          config.Presence.Claims,
+			Webhook:         f.webhook,
+		},
+	).Handle(w, r)
+}
+
+// readiness probes for a connected broker node, for not draining and for
+// free stream capacity.
+func (f *factory) readiness() []serv.Probe {
+	probes := []serv.Probe{serv.DrainProbe(f.drain)}
+
+	if f.brokers != nil {
+		probes = append(probes, func() error {
+			if f.brokers.Connected() == 0 {
+				return errNoBroker
+			}
+			return nil
+		})
+	}
+	if f.limiter != nil {
+		probes = append(probes, serv.LimitProbe(f.limiter))
+	}
+	return probes
+}
+
+func (f *factory) prometheus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := f.metric.WritePrometheus(w); err != nil {
+		f.logger.Warn("metric: write failed", "error", err)
+	}
+}
+
+func (f *factory) confirmation(w http.ResponseWriter, r *http.Request) {
+	config := f.state.Config()
+
+	serv.NewConfirmHandler(
+		f.confirm,
+		&serv.ResponseHeader{
+			CORS: config.Header.CORS,
+		},
 	).Handle(w, r)
 }
 
-func yieldConn(config conf.Config, metric metric.Metric) <-chan broker.Connection {
+// instance identifies this process in presence events, by host name and
+// pid unless configured.
+func instance(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+func newConnector(config conf.Config, metric metric.Metric, logger *slog.Logger) broker.Connector {
+	dialer, err := broker.NewDialer(config.Broker.Type)
+	if err != nil {
+		logger.Error(err.Error())
+		return broker.NewConnector(dialer, nil, metric, logger)
+	}
+
+	return broker.NewConnector(dialer, brokerURLs(config, logger), metric, logger)
+}
+
+// brokerURLs parses the broker nodes, invalid ones are logged and skipped.
+func brokerURLs(config conf.Config, logger *slog.Logger) []*url.URL {
 	var urls []*url.URL
 
 	for _, v := range config.Broker.Node {
-		if u, err := url.Parse(v); err != nil {
-			log.Printf("%s", err)
+		if u, err := broker.ParseNode(v); err != nil {
+			logger.Error("broker: invalid node", "error", err)
 		} else {
 			urls = append(urls, u)
 		}
 	}
-
-	return broker.NewConnector(amqp.Dial, urls, metric).Connection()
+	return urls
 }
@@ -5,6 +5,11 @@ package app
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strings"
+
+	"eventsourced/intern/broker"
+	"eventsourced/intern/conf"
 
 	"gopkg.in/yaml.v2"
 )
@@ -13,23 +18,80 @@ type (
 	// GetOpt ...
 	GetOpt interface {
 		Complement(s State) bool
+		ExitCode() int
+		ConfigFile() string
+		Override(c *conf.Config) []string
 	}
 	getOpt struct {
-		version  *bool
-		confdump *bool
+		version    *bool
+		confdump   *bool
+		test       *bool
+		config     *string
+		address    *string
+		brokerType *string
+		brokerNode stringList
+		logLevel   *string
+		logFormat  *string
+		args       []string
+		exitCode   int
 	}
+
+	// stringList collects the values of a repeated flag.
+	stringList []string
 )
 
+// redacted replaces secrets in the configuration dump.
+const redacted = "xxxxx"
+
 // NewGetOpt ...
 func NewGetOpt() GetOpt {
 	options := &getOpt{
-		version:  flag.Bool("v", false, "display version"),
-		confdump: flag.Bool("c", false, "dump configuration"),
+		version:    flag.Bool("v", false, "display version"),
+		confdump:   flag.Bool("c", false, "dump configuration"),
+		test:       flag.Bool("t", false, "test configuration and exit"),
+		config:     flag.String("config", "", "read configuration from `path` only"),
+		address:    flag.String("address", "", "listen on `address`, see server.address"),
+		brokerType: flag.String("broker-type", "", "broker `type`, see broker.type"),
+		logLevel:   flag.String("log-level", "", "log `level`, see log.level"),
+		logFormat:  flag.String("log-format", "", "log `format`, see log.format"),
 	}
+	flag.Var(&options.brokerNode, "broker-node", "broker node `url`, repeated for each node, see broker.node")
+	flag.Usage = usage
 	flag.Parse()
+	options.args = flag.Args()
 	return options
 }
 
+// ConfigFile returns the path given by -config, empty when not given.
+func (o *getOpt) ConfigFile() string {
+	if o.config == nil {
+		return ""
+	}
+	return *o.config
+}
+
+// Override sets the entries given by flags, returns the flags applied.
+func (o *getOpt) Override(c *conf.Config) []string {
+	var applied []string
+
+	set := func(name string, value *string, entry *string) {
+		if value != nil && *value != "" {
+			*entry = *value
+			applied = append(applied, name)
+		}
+	}
+	set("address", o.address, &c.Server.Address)
+	set("broker-type", o.brokerType, &c.Broker.Type)
+	set("log-level", o.logLevel, &c.Log.Level)
+	set("log-format", o.logFormat, &c.Log.Format)
+
+	if len(o.brokerNode) > 0 {
+		c.Broker.Node = append([]string(nil), o.brokerNode...)
+		applied = append(applied, "broker-node")
+	}
+	return applied
+}
+
 func (o *getOpt) Complement(s State) bool {
 	if *o.version {
 		fmt.Println(s.Version().Long())
@@ -37,12 +99,70 @@ func (o *getOpt) Complement(s State) bool {
 	}
 
 	if *o.confdump {
-		j, _ := yaml.Marshal(s.Config())
+		j, _ := yaml.Marshal(redact(s.Config()))
 		fmt.Printf("%s", j)
 		return false
 	}
 
+	if o.test != nil && *o.test {
+		if err := Validate(s.Config()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			o.exitCode = 1
+			return false
+		}
+		fmt.Printf("config: %s ok\n", strings.Join(append([]string{"defaults"}, s.Config().Source()...), ", "))
+		return false
+	}
+
+	if len(o.args) > 0 && o.args[0] == "healthcheck" {
+		ready := len(o.args) > 1 && o.args[1] == "ready"
+		if err := healthcheck(s.Config().Server.Address, ready); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			o.exitCode = 1
+		}
+		return false
+	}
+
 	// ...
 
 	return true
 }
+
+// ExitCode tells the exit status after Complement returned false.
+func (o *getOpt) ExitCode() int {
+	return o.exitCode
+}
+
+// String ...
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set ...
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// redact masks the secrets of the configuration for display, the broker
+// nodes as broker.Redact does.
+func redact(c conf.Config) conf.Config {
+	nodes := make([]string, len(c.Broker.Node))
+	for i, node := range c.Broker.Node {
+		nodes[i] = broker.Redact(node)
+	}
+	c.Broker.Node = nodes
+
+	for _, secret := range []*string{&c.Admin.Token, &c.Webhook.Secret} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return c
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	_, _ = fmt.Fprintf(out, "Usage: %s [options] [healthcheck [ready]]\n", os.Args[0])
+	flag.PrintDefaults()
+}
@@ -0,0 +1,41 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const healthcheckTimeout = 5 * time.Second
+
+// healthcheck requests /healthz, or /readyz when ready, from the server
+// listening on the given address.
+func healthcheck(address string, ready bool) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	path := "/healthz"
+	if ready {
+		path = "/readyz"
+	}
+
+	client := &http.Client{Timeout: healthcheckTimeout}
+	res, err := client.Get("http://" + net.JoinHostPort(host, port) + path)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d, %s", path, res.StatusCode, res.Header.Get("X-Status-Reason"))
+	}
+	return nil
+}
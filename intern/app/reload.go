@@ -0,0 +1,44 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package app
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"eventsourced/intern/conf"
+)
+
+// ReloadOnHangup updates the state with the configuration returned by load
+// on SIGHUP, until the returned function is called. A configuration load
+// fails for is logged and the current one kept.
+func ReloadOnHangup(state State, load func() (conf.Config, error), logger *slog.Logger) func() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-sig:
+				config, err := load()
+				if err != nil {
+					logger.Error("config: reload failed", "error", strings.ReplaceAll(err.Error(), "\n", "; "))
+					continue
+				}
+				state.Update(config)
+				logger.Info("config: reloaded", "source", strings.Join(config.Source(), ", "))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sig)
+		close(done)
+	}
+}
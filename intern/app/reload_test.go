@@ -0,0 +1,54 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package app
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"eventsourced/intern/conf"
+	"eventsourced/intern/logging"
+)
+
+// Must update the state on SIGHUP, keeping it when loading failed
+func TestReloadOnHangup(t *testing.T) {
+	state := NewState(NewVersion("", "", "", ""), conf.NewConfig())
+	updated := make(chan conf.Config, 1)
+	state.Subscribe(func(_, config conf.Config) { updated <- config })
+
+	loads := make(chan error, 2)
+	stop := ReloadOnHangup(state, func() (conf.Config, error) {
+		config := conf.NewConfig()
+		config.Queue.Pattern = "${cookie:id}"
+		err := <-loads
+		return config, err
+	}, logging.Discard())
+	defer stop()
+
+	hangup := func() {
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loads <- errors.New("invalid")
+	hangup()
+	select {
+	case <-updated:
+		t.Fatal("unexpected update")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	loads <- nil
+	hangup()
+	select {
+	case config := <-updated:
+		if config.Queue.Pattern != "${cookie:id}" || state.Config().Queue.Pattern != "${cookie:id}" {
+			t.Errorf("unexpected pattern %q", config.Queue.Pattern)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected update")
+	}
+}
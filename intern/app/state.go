@@ -3,6 +3,8 @@
 package app
 
 import (
+	"sync"
+
 	"eventsourced/intern/conf"
 )
 
@@ -11,10 +13,15 @@ type (
 	State interface {
 		Version() Version
 		Config() conf.Config
+		Update(config conf.Config)
+		Subscribe(f func(old, config conf.Config))
 	}
 	state struct {
 		version Version
-		config  conf.Config
+
+		mu          sync.RWMutex
+		config      conf.Config
+		subscribers []func(old, config conf.Config)
 	}
 )
 
@@ -31,5 +38,31 @@ func (s *state) Version() Version {
 }
 
 func (s *state) Config() conf.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return s.config
 }
+
+// Update replaces the configuration at once, then calls the subscribers
+// in order of subscription.
+func (s *state) Update(config conf.Config) {
+	s.mu.Lock()
+	old := s.config
+	s.config = config
+	subscribers := s.subscribers
+	s.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(old, config)
+	}
+}
+
+// Subscribe calls f with the previous and the new configuration on each
+// update.
+func (s *state) Subscribe(f func(old, config conf.Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscribers = append(s.subscribers, f)
+}
@@ -22,3 +22,23 @@ func TestState(t *testing.T) {
 		t.Error("expected equality")
 	}
 }
+
+func TestState_Update(t *testing.T) {
+	state := NewState(NewVersion("", "", "", ""), conf.NewConfig(""))
+
+	var calls []string
+	state.Subscribe(func(old, config conf.Config) {
+		calls = append(calls, old.Queue.Pattern+" "+config.Queue.Pattern)
+	})
+
+	config := conf.NewConfig("")
+	config.Queue.Pattern = "${cookie:id}"
+	state.Update(config)
+
+	if state.Config().Queue.Pattern != "${cookie:id}" {
+		t.Error("expected updated config")
+	}
+	if len(calls) != 1 || calls[0] != "${query:id} ${cookie:id}" {
+		t.Errorf("unexpected calls %v", calls)
+	}
+}
@@ -0,0 +1,192 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"eventsourced/intern/broker"
+	"eventsourced/intern/conf"
+	"eventsourced/intern/logging"
+	"eventsourced/intern/serv"
+)
+
+// validator collects the errors of a configuration, each located by the
+// path of its entry.
+type validator struct {
+	errs []error
+}
+
+// Validate returns the errors reading the configuration files and the
+// entries not valid, nil when there are none.
+func Validate(c conf.Config) error {
+	v := &validator{}
+	if err := c.Err(); err != nil {
+		v.errs = append(v.errs, err)
+	}
+
+	v.address("server.address", c.Server.Address)
+	v.notNegative("server.heartbeat", c.Server.Heartbeat)
+	v.notNegative("server.write_timeout", c.Server.WriteTimeout)
+	v.notNegative("server.max_idle", c.Server.MaxIdle)
+	v.notNegative("server.retry", c.Server.Retry)
+	v.notNegative("server.min_throughput", c.Server.MinThroughput)
+	v.notNegative("server.drain", c.Server.Drain)
+	v.notNegative("server.retry_jitter", c.Server.RetryJitter)
+	v.notNegative("server.max_streams", c.Server.MaxStreams)
+	if p := c.Server.SlowPolicy; p != "" && p != serv.SlowDisconnect && p != serv.SlowShed {
+		v.fail("server.slow_policy", fmt.Errorf("unknown policy %q", p))
+	}
+
+	if _, err := broker.NewDialer(c.Broker.Type); err != nil {
+		v.fail("broker.type", err)
+	}
+	if len(c.Broker.Node) == 0 {
+		v.fail("broker.node", errors.New("no node"))
+	}
+	for i, node := range c.Broker.Node {
+		v.node(fmt.Sprintf("broker.node[%d]", i), node)
+	}
+
+	v.check("queue.pattern", serv.ValidatePattern(c.Queue.Pattern))
+	v.positive("queue.expires", c.Queue.Expires)
+	v.notNegative("queue.confirm", c.Queue.Confirm)
+	v.notNegative("queue.prefetch", c.Queue.Prefetch)
+	v.notNegative("queue.redeliver", c.Queue.Redeliver)
+	if h := c.Queue.Latency.Header; h != "" && !validHeaderName(h) {
+		v.fail("queue.latency.header", fmt.Errorf("invalid header name %q", h))
+	}
+
+	v.header("header.cors", c.Header.CORS)
+	v.header("header.sse", c.Header.SSE)
+
+	if c.Tracing.Endpoint != "" {
+		v.url("tracing.endpoint", c.Tracing.Endpoint)
+	}
+	if c.Tracing.Sample < 0 || c.Tracing.Sample > 1 {
+		v.fail("tracing.sample", fmt.Errorf("%v not within 0 and 1", c.Tracing.Sample))
+	}
+
+	if _, err := logging.NewLogger(io.Discard, c.Log); err != nil {
+		v.fail("log", err)
+	}
+	v.notNegative("log.messages", c.Log.Messages)
+
+	if c.Admin.Address != "" {
+		v.address("admin.address", c.Admin.Address)
+		if c.Admin.Token == "" {
+			v.fail("admin.token", errors.New("required by admin.address"))
+		}
+	}
+
+	v.check("presence.claims", serv.Claims(c.Presence.Claims).Validate())
+
+	if c.Webhook.Authorize != "" {
+		v.url("webhook.authorize", c.Webhook.Authorize)
+	}
+	if c.Webhook.Closed != "" {
+		v.url("webhook.closed", c.Webhook.Closed)
+	}
+	v.notNegative("webhook.timeout", c.Webhook.Timeout)
+	v.notNegative("webhook.retries", c.Webhook.Retries)
+
+	return errors.Join(v.errs...)
+}
+
+func (v *validator) fail(path string, err error) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %w", path, err))
+}
+
+func (v *validator) check(path string, err error) {
+	if err != nil {
+		v.fail(path, err)
+	}
+}
+
+func (v *validator) notNegative(path string, n int) {
+	if n < 0 {
+		v.fail(path, fmt.Errorf("%d is negative", n))
+	}
+}
+
+// positive fails for n not above zero, e.g. AMQP rejects an x-expires of 0.
+func (v *validator) positive(path string, n int) {
+	if n <= 0 {
+		v.fail(path, fmt.Errorf("%d is not positive", n))
+	}
+}
+
+func (v *validator) address(path, address string) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		v.fail(path, err)
+		return
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		v.fail(path, fmt.Errorf("invalid port %q", port))
+	}
+}
+
+func (v *validator) node(path, node string) {
+	u, err := broker.ParseNode(node)
+	if err != nil {
+		// The URL in the error may hold credentials.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		v.fail(path, err)
+		return
+	}
+	if u.Scheme == "" || u.Host == "" {
+		v.fail(path, fmt.Errorf("%q lacks scheme or host", broker.Redact(node)))
+	}
+}
+
+func (v *validator) url(path, raw string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.fail(path, err)
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.fail(path, fmt.Errorf("%q is no absolute HTTP URL", raw))
+	}
+}
+
+func (v *validator) header(path string, header map[string]string) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !validHeaderName(name) {
+			v.fail(path, fmt.Errorf("invalid header name %q", name))
+		}
+		if strings.ContainsAny(header[name], "\r\n\x00") {
+			v.fail(path+"."+name, errors.New("invalid header value"))
+		}
+	}
+}
+
+// validHeaderName tells whether name is an HTTP token.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
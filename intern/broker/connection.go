@@ -4,67 +4,279 @@ package broker
 
 import (
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
 type (
-	// Connection represents an observable connection to an AMQP broker.
+	// Connection represents an observable connection to a message broker.
 	Connection interface {
-		Channel() (*amqp.Channel, error)
+		Subscribe(queue string, options Options) (Subscription, error)
 		Notify(err chan error) chan error
 		Ignore(err chan error)
 		Close() error
 	}
 	connection struct {
+		notifier
 		conn *amqp.Connection
 
-		mu  sync.Mutex
-		err map[chan error]bool
+		mu       sync.Mutex
+		pub      *amqp.Channel
+		confirms chan amqp.Confirmation
+		returns  chan amqp.Return
+		declared map[string]bool
 	}
+
+	// Options ...
+	Options struct {
+		// Expires is the lifetime of an unused queue in seconds.
+		Expires int
+		// Prefetch is the number of unacked messages delivered ahead,
+		// at least one.
+		Prefetch int
+		// LastID is the id of the last message seen, to resume after.
+		LastID string
+	}
+)
+
+// publishTimeout bounds the wait for the broker to confirm a message.
+const publishTimeout = 5 * time.Second
+
+var (
+	errPublishClosed  = errors.New("broker: publish channel closed")
+	errPublishNacked  = errors.New("broker: message not confirmed")
+	errPublishTimeout = errors.New("broker: publish timeout")
 )
 
+// DialAMQP is the Dialer for AMQP broker nodes.
+func DialAMQP(url string) (Connection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return newConnection(conn), nil
+}
+
 func newConnection(conn *amqp.Connection) Connection {
-	p := &connection{conn: conn, err: map[chan error]bool{}}
-	go func() { p.dispatch(<-conn.NotifyClose(make(chan *amqp.Error))) }()
+	p := &connection{conn: conn}
+	go func() {
+		if err := <-conn.NotifyClose(make(chan *amqp.Error)); err != nil {
+			p.dispatch(errors.New(err.Error()))
+		}
+	}()
 	return p
 }
 
-// Channel ...
-func (p *connection) Channel() (*amqp.Channel, error) {
-	return p.conn.Channel()
+// Subscribe declares the queue and starts consuming from it. AMQP queues
+// have no notion of a resume position, so LastID is ignored.
+func (p *connection) Subscribe(name string, options Options) (Subscription, error) {
+	var err error
+	var ch *amqp.Channel
+	var q amqp.Queue
+	var d <-chan amqp.Delivery
+
+	var args = options.arguments()
+
+	if ch, err = p.conn.Channel(); err != nil {
+		return nil, err
+	}
+
+	if q, err = ch.QueueDeclare(
+		name,
+		true,  // durable
+		false, // autoDelete
+		false, // exclusive
+		false, // noWait
+		args,
+	); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+
+	if q.Consumers != 0 {
+		_ = ch.Close()
+		return nil, errMaxConsumers
+	}
+	if err = ch.Qos(options.prefetch(), 0, false); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+
+	if d, err = ch.Consume(
+		name,
+		"",    // consumer
+		false, // autoAck
+		false, // exclusive
+		false, // noLocal
+		false, // noWait
+		args,
+	); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+
+	return newSubscription(ch, name, d, options.prefetch()), nil
 }
 
-// Close ...
-func (p *connection) Close() error {
-	return p.conn.Close()
+// DeclareQueue declares the queue as Subscribe does, unless it exists.
+func (p *connection) DeclareQueue(name string, options Options) (QueueInfo, error) {
+	var q amqp.Queue
+
+	err := p.channel(func(ch *amqp.Channel) (err error) {
+		q, err = ch.QueueDeclare(name, true, false, false, false, options.arguments())
+		return err
+	})
+	return QueueInfo{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}, err
 }
 
-// Notify ...
-func (p *connection) Notify(err chan error) chan error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+// InspectQueue ...
+func (p *connection) InspectQueue(name string) (QueueInfo, error) {
+	var q amqp.Queue
 
-	p.err[err] = true
-	return err
+	err := p.channel(func(ch *amqp.Channel) (err error) {
+		q, err = ch.QueueInspect(name)
+		return err
+	})
+	return QueueInfo{Name: q.Name, Messages: q.Messages, Consumers: q.Consumers}, err
+}
+
+// PurgeQueue drops the ready messages, unacked ones are not affected.
+func (p *connection) PurgeQueue(name string) (int, error) {
+	var n int
+
+	err := p.channel(func(ch *amqp.Channel) (err error) {
+		if _, err = ch.QueueInspect(name); err == nil {
+			n, err = ch.QueuePurge(name, false)
+		}
+		return err
+	})
+	return n, err
 }
 
-// Ignore ...
-func (p *connection) Ignore(err chan error) {
+// DeleteQueue deletes the queue, its consumer is cancelled.
+func (p *connection) DeleteQueue(name string) (int, error) {
+	var n int
+
+	err := p.channel(func(ch *amqp.Channel) (err error) {
+		if _, err = ch.QueueInspect(name); err == nil {
+			n, err = ch.QueueDelete(name, false, false, false)
+		}
+		return err
+	})
+	return n, err
+}
+
+// Publish sends a transient message to the exchange, on a channel kept
+// for publishing. The exchange is declared as durable topic exchange, the
+// message published mandatory and confirmed, so a message not routed to
+// any queue or not taken by the broker fails. The channel is renewed
+// after failures.
+func (p *connection) Publish(exchange, key string, body []byte) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	delete(p.err, err)
+	err := p.publish(exchange, key, body)
+	if err != nil && p.pub != nil {
+		_ = p.pub.Close()
+		p.pub = nil
+	}
+	return err
 }
 
-func (p *connection) dispatch(err *amqp.Error) {
+func (p *connection) publish(exchange, key string, body []byte) error {
+	if p.pub == nil {
+		ch, err := p.conn.Channel()
+		if err != nil {
+			return err
+		}
+		p.pub = ch
+		if err = ch.Confirm(false); err != nil {
+			return err
+		}
+		p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+		p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+		p.declared = map[string]bool{}
+	}
+
+	if !p.declared[exchange] {
+		if err := p.pub.ExchangeDeclare(exchange, "topic", true, false, false, false, nil); err != nil {
+			return err
+		}
+		p.declared[exchange] = true
+	}
+
+	err := p.pub.Publish(exchange, key, true, false, amqp.Publishing{
+		ContentType: "application/json",
+		Timestamp:   time.Now(),
+		Body:        body,
+	})
 	if err != nil {
-		p.mu.Lock()
-		defer p.mu.Unlock()
+		return err
+	}
+
+	timeout := time.NewTimer(publishTimeout)
+	defer timeout.Stop()
 
-		for listener := range p.err {
-			listener <- errors.New(err.Error())
+	select {
+	case c, ok := <-p.confirms:
+		if !ok {
+			return errPublishClosed
 		}
+		if !c.Ack {
+			return errPublishNacked
+		}
+	case <-timeout.C:
+		return errPublishTimeout
+	}
+
+	// A message not routed is returned ahead of its confirmation.
+	select {
+	case r := <-p.returns:
+		return fmt.Errorf("broker: message returned: %s", r.ReplyText)
+	default:
+		return nil
+	}
+}
+
+// Close ...
+func (p *connection) Close() error {
+	return p.conn.Close()
+}
+
+// channel runs f on a channel of its own, as failing operations close the
+// channel. A queue not found is reported as ErrNoQueue.
+func (p *connection) channel(f func(ch *amqp.Channel) error) error {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = ch.Close() }()
+
+	err = f(ch)
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.NotFound {
+		return ErrNoQueue
+	}
+	return err
+}
+
+// arguments of the queue declaration, the same for all declarations of
+// a queue.
+func (o Options) arguments() amqp.Table {
+	return amqp.Table{
+		"x-expires": int32(o.Expires * 1000),
+	}
+}
+
+func (o Options) prefetch() int {
+	if o.Prefetch < 1 {
+		return 1
 	}
+	return o.Prefetch
 }
@@ -3,100 +3,270 @@
 package broker
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"eventsourced/intern/metric"
-
-	"github.com/streadway/amqp"
 )
 
 type (
-	// Connector provides AMQP connection on demand.
+	// Connector provides broker connections on demand. Connected tells
+	// the number of nodes currently connected, Reconcile applies a changed
+	// list of nodes.
 	Connector interface {
 		Connection() <-chan Connection
+		Connected() int
+		Reconcile(brokers []*url.URL, drain time.Duration)
 	}
 	connector struct {
-		dialer  Dialer
+		dialer    Dialer
+		metric    metric.Metric
+		logger    *slog.Logger
+		connected int64
+
+		mu      sync.Mutex
 		brokers []*url.URL
-		metric  metric.Metric
+		yield   chan Connection
+		// nodes holds a retire channel per provider, by node URL, as the
+		// same URL may be repeated.
+		nodes map[string][]chan time.Duration
 	}
 
-	// Dialer is the callback function that provides an AMQP connection.
-	Dialer = func(url string) (*amqp.Connection, error)
+	// Dialer is the callback function that provides a broker connection.
+	Dialer = func(url string) (Connection, error)
+
+	nodeConnection struct {
+		Connection
+		node string
+	}
 )
 
-// NewConnector creates a new broker connector.
+// NewConnector creates a new broker connector, logging to the default
+// logger when none is given.
 func NewConnector(
 	dialer Dialer,
 	brokers []*url.URL,
 	metric metric.Metric,
+	logger *slog.Logger,
 ) Connector {
-	return &connector{dialer, brokers, metric}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &connector{dialer: dialer, brokers: brokers, metric: metric, logger: logger}
+}
+
+// Connected ...
+func (p *connector) Connected() int {
+	return int(atomic.LoadInt64(&p.connected))
 }
 
-// Connection yields a broker connection on demand
+// Connection yields a broker connection on demand, from one provider per
+// node. Repeated calls return the same channel.
 func (p *connector) Connection() <-chan Connection {
-	yield := make(chan Connection)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.yield != nil {
+		return p.yield
+	}
+	p.yield = make(chan Connection)
+	p.nodes = map[string][]chan time.Duration{}
 
-	provide := func(brokerURL *url.URL) {
-		var brConn Connection
-		var onErr chan error
+	for _, brokerURL := range p.brokers {
+		p.start(brokerURL)
+	}
 
+	// detect connection loss when idle
+	go func(yield <-chan Connection) {
 		for {
-			if brConn == nil {
-				amqpConn, err := p.dialer(brokerURL.String())
+			<-yield
+			time.Sleep(1 * time.Second)
+		}
+	}(p.yield)
 
-				if err != nil {
-					log.Printf("dialer: %s", err)
-					time.Sleep(5 * time.Second)
-					continue
-				}
+	return p.yield
+}
 
-				brConn = newConnection(amqpConn)
-				onErr = brConn.Notify(make(chan error))
-				connected(brokerURL, p.metric)
-			}
+// Reconcile starts providers for the nodes added and retires those of the
+// nodes removed: they yield no further connections and close theirs after
+// the drain period, so the streams using them end and reconnect to other
+// nodes. Nodes are compared by URL, counting repeated ones.
+func (p *connector) Reconcile(brokers []*url.URL, drain time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-			select {
-			case err := <-onErr:
-				brConn = nil
-				disconnected(brokerURL, err, p.metric)
+	p.brokers = brokers
+	if p.yield == nil {
+		return
+	}
+
+	wanted := map[string]int{}
+	for _, brokerURL := range brokers {
+		wanted[brokerURL.String()]++
+		if wanted[brokerURL.String()] > len(p.nodes[brokerURL.String()]) {
+			p.logger.Info("broker: node added", "node", sanitize(brokerURL))
+			p.start(brokerURL)
+		}
+	}
+
+	for node, retire := range p.nodes {
+		for len(retire) > wanted[node] {
+			u, _ := url.Parse(node)
+			p.logger.Info("broker: node removed", "node", sanitize(u), "drain", drain.String())
+			retire[len(retire)-1] <- drain
+			retire = retire[:len(retire)-1]
+		}
+		if p.nodes[node] = retire; len(retire) == 0 {
+			delete(p.nodes, node)
+		}
+	}
+}
+
+// start runs a provider for the node, p.mu must be held.
+func (p *connector) start(brokerURL *url.URL) {
+	retire := make(chan time.Duration, 1)
+	p.nodes[brokerURL.String()] = append(p.nodes[brokerURL.String()], retire)
+	go p.provide(brokerURL, retire)
+}
+
+// provide yields the connection to the node, redialed when lost, until it
+// is retired.
+func (p *connector) provide(brokerURL *url.URL, retire <-chan time.Duration) {
+	var brConn Connection
+	var onErr chan error
+
+	// wait tells whether the provider was retired while waiting to redial.
+	wait := func() bool {
+		select {
+		case <-retire:
+			return true
+		case <-time.After(5 * time.Second):
+			return false
+		}
+	}
+
+	for {
+		if brConn == nil {
+			// Secrets are resolved on each dial to pick up rotated ones.
+			resolved, err := resolveSecrets(brokerURL)
+			if err != nil {
+				p.logger.Error("broker: secret failed", "node", sanitize(brokerURL), "error", err)
+				if wait() {
+					return
+				}
 				continue
+			}
+			conn, err := p.dialer(resolved.String())
 
-			default:
-				yield <- brConn
+			if err != nil {
+				p.logger.Error("broker: dial failed", "node", sanitize(brokerURL), "error", err)
+				if wait() {
+					return
+				}
+				continue
 			}
+
+			brConn = &nodeConnection{conn, sanitize(brokerURL)}
+			onErr = brConn.Notify(make(chan error))
+			p.connect(brokerURL)
+		}
+
+		select {
+		case err := <-onErr:
+			brConn = nil
+			p.disconnect(brokerURL, err)
+			continue
+
+		default:
+		}
+
+		select {
+		case err := <-onErr:
+			brConn = nil
+			p.disconnect(brokerURL, err)
+
+		case drain := <-retire:
+			p.retire(brokerURL, brConn, onErr, drain)
+			return
+
+		case p.yield <- brConn:
 		}
 	}
+}
 
-	for _, brokerURL := range p.brokers {
-		go provide(brokerURL)
+// Node returns the sanitized URL of the broker node a connection yielded
+// by a Connector belongs to.
+func Node(conn Connection) string {
+	if c, ok := conn.(*nodeConnection); ok {
+		return c.node
 	}
+	return ""
+}
 
-	// detect connection loss when idle
+func (p *connector) connect(brokerURL *url.URL) {
+	atomic.AddInt64(&p.connected, 1)
+	p.metric.IncBrokerCount(sanitize(brokerURL))
+	p.logger.Info("broker: connected", "node", sanitize(brokerURL))
+}
+
+// retire stops observing the connection and closes it after the drain
+// period.
+func (p *connector) retire(brokerURL *url.URL, conn Connection, onErr chan error, drain time.Duration) {
+	// A failure dispatched meanwhile must not block Ignore.
+	ignored := make(chan struct{})
 	go func() {
 		for {
-			<-yield
-			time.Sleep(1 * time.Second)
+			select {
+			case <-onErr:
+			case <-ignored:
+				return
+			}
 		}
 	}()
+	conn.Ignore(onErr)
+	close(ignored)
 
-	return yield
-}
+	atomic.AddInt64(&p.connected, -1)
+	p.metric.DecBrokerCount(sanitize(brokerURL))
 
-func connected(brokerURL *url.URL, metric metric.Metric) {
-	metric.IncBrokerCount()
-	log.Printf("broker: connected %s", sanitize(brokerURL))
+	time.AfterFunc(drain, func() {
+		_ = conn.Close()
+		p.logger.Info("broker: disconnected", "node", sanitize(brokerURL))
+	})
 }
 
-func disconnected(brokerURL *url.URL, err error, metric metric.Metric) {
-	metric.DecBrokerCount()
+func (p *connector) disconnect(brokerURL *url.URL, err error) {
+	atomic.AddInt64(&p.connected, -1)
+	p.metric.DecBrokerCount(sanitize(brokerURL))
 	if err != nil {
-		log.Printf("broker: closing %s", err)
+		p.logger.Warn("broker: disconnected", "node", sanitize(brokerURL), "error", err)
+		return
+	}
+	p.logger.Info("broker: disconnected", "node", sanitize(brokerURL))
+}
+
+// NewDialer returns the Dialer for the given broker type.
+func NewDialer(kind string) (Dialer, error) {
+	switch kind {
+	case "", "amqp":
+		return DialAMQP, nil
+	case "memory":
+		return DialMemory, nil
+	case "redis":
+		return DialRedis, nil
+	case "nats":
+		return DialNATS, nil
+	case "jetstream":
+		return DialJetStream, nil
+	case "mqtt":
+		return DialMQTT, nil
+	default:
+		return nil, fmt.Errorf("broker: unknown type %q", kind)
 	}
-	log.Printf("broker: disconnected %s", sanitize(brokerURL))
 }
 
 func sanitize(url *url.URL) string {
@@ -0,0 +1,452 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type (
+	// Memory is an in-process message broker, addressed by memory:// URLs.
+	// It mimics the queue semantics eventsourced relies on: queues expire
+	// when unused, allow a single consumer and redeliver unacked messages.
+	Memory interface {
+		Declare(queue string, expires int) error
+		Publish(queue string, body []byte) error
+		Delete(queue string) error
+	}
+	memory struct {
+		mu     sync.Mutex
+		queues map[string]*memQueue
+	}
+	memQueue struct {
+		name     string
+		messages []memEntry
+		consumer *memSubscription
+		expires  time.Duration
+		expiry   *time.Timer
+		ready    chan struct{}
+	}
+	memConnection struct {
+		notifier
+		tracker
+		broker *memory
+	}
+	memSubscription struct {
+		broker   *memory
+		queue    *memQueue
+		prefetch int
+		messages chan Message
+		done     chan struct{}
+		stopped  chan struct{}
+		once     sync.Once
+	}
+	memEntry struct {
+		body       []byte
+		deliveries int
+		published  time.Time
+	}
+	memMessage struct {
+		memEntry
+		acked   chan struct{}
+		once    sync.Once
+		requeue bool
+	}
+)
+
+var (
+	memories = struct {
+		sync.Mutex
+		m map[string]*memory
+	}{m: map[string]*memory{}}
+
+	errConnClosed = errors.New("broker: connection closed")
+)
+
+// OpenMemory returns the named in-memory broker, creating it on first use.
+func OpenMemory(name string) Memory {
+	return openMemory(name)
+}
+
+// DialMemory is the Dialer for in-memory broker nodes. The host part of
+// the URL names the broker instance, e.g. memory://local.
+func DialMemory(rawURL string) (Connection, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &memConnection{broker: openMemory(u.Host)}, nil
+}
+
+func openMemory(name string) *memory {
+	memories.Lock()
+	defer memories.Unlock()
+
+	m, ok := memories.m[name]
+	if !ok {
+		m = &memory{queues: map[string]*memQueue{}}
+		memories.m[name] = m
+	}
+	return m
+}
+
+// Declare creates the queue unless it exists.
+func (m *memory) Declare(name string, expires int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.declare(name, expires)
+	return nil
+}
+
+// Publish appends a message to the queue.
+func (m *memory) Publish(name string, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[name]
+	if !ok {
+		return ErrNoQueue
+	}
+	q.messages = append(q.messages, memEntry{body: body, published: time.Now()})
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Delete drops the queue and cancels its consumer.
+func (m *memory) Delete(name string) error {
+	var consumer *memSubscription
+
+	m.mu.Lock()
+	q, ok := m.queues[name]
+	if ok {
+		consumer = q.consumer
+		m.drop(q)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return ErrNoQueue
+	}
+	if consumer != nil {
+		_ = consumer.Close()
+	}
+	return nil
+}
+
+func (m *memory) subscribe(name string, options Options) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := m.declare(name, options.Expires)
+	if q.consumer != nil {
+		return nil, errMaxConsumers
+	}
+	if q.expiry != nil {
+		q.expiry.Stop()
+	}
+
+	s := &memSubscription{
+		broker:   m,
+		queue:    q,
+		prefetch: options.prefetch(),
+		messages: make(chan Message, options.prefetch()),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	q.consumer = s
+
+	go s.run()
+	return s, nil
+}
+
+// declare must be called with the broker lock held.
+func (m *memory) declare(name string, expires int) *memQueue {
+	q, ok := m.queues[name]
+	if !ok {
+		q = &memQueue{
+			name:    name,
+			expires: time.Duration(expires) * time.Second,
+			ready:   make(chan struct{}, 1),
+		}
+		m.queues[name] = q
+	}
+	if q.consumer == nil {
+		m.unused(q)
+	}
+	return q
+}
+
+// info must be called with the broker lock held.
+func (q *memQueue) info() QueueInfo {
+	info := QueueInfo{Name: q.name, Messages: len(q.messages)}
+	if q.consumer != nil {
+		info.Consumers = 1
+	}
+	return info
+}
+
+// unused (re)arms the expiry of a queue without consumer, lock held.
+func (m *memory) unused(q *memQueue) {
+	if q.expires <= 0 {
+		return
+	}
+	if q.expiry != nil {
+		q.expiry.Stop()
+	}
+	q.expiry = time.AfterFunc(q.expires, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if m.queues[q.name] == q && q.consumer == nil {
+			m.drop(q)
+		}
+	})
+}
+
+// drop must be called with the broker lock held.
+func (m *memory) drop(q *memQueue) {
+	if q.expiry != nil {
+		q.expiry.Stop()
+	}
+	delete(m.queues, q.name)
+}
+
+// take removes up to n entries from the head of the queue.
+func (m *memory) take(q *memQueue, n int) []memEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if n > len(q.messages) {
+		n = len(q.messages)
+	}
+	entries := make([]memEntry, n)
+	copy(entries, q.messages)
+	q.messages = q.messages[n:]
+
+	for i := range entries {
+		entries[i].deliveries++
+	}
+	return entries
+}
+
+func (m *memory) requeue(q *memQueue, entries []memEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q.messages = append(entries, q.messages...)
+}
+
+func (m *memory) detach(s *memSubscription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s.queue.consumer == s {
+		s.queue.consumer = nil
+		if m.queues[s.queue.name] == s.queue {
+			m.unused(s.queue)
+		}
+	}
+}
+
+// Subscribe ...
+func (c *memConnection) Subscribe(name string, options Options) (Subscription, error) {
+	sub, err := c.broker.subscribe(name, options)
+	if err != nil {
+		return nil, err
+	}
+	return c.track(sub)
+}
+
+// DeclareQueue ...
+func (c *memConnection) DeclareQueue(name string, options Options) (QueueInfo, error) {
+	m := c.broker
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.declare(name, options.Expires).info(), nil
+}
+
+// InspectQueue ...
+func (c *memConnection) InspectQueue(name string) (QueueInfo, error) {
+	m := c.broker
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if q, ok := m.queues[name]; ok {
+		return q.info(), nil
+	}
+	return QueueInfo{}, ErrNoQueue
+}
+
+// PurgeQueue drops the ready messages, those delivered to the consumer
+// are not affected.
+func (c *memConnection) PurgeQueue(name string) (int, error) {
+	m := c.broker
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[name]
+	if !ok {
+		return 0, ErrNoQueue
+	}
+	n := len(q.messages)
+	q.messages = nil
+	return n, nil
+}
+
+// DeleteQueue ...
+func (c *memConnection) DeleteQueue(name string) (int, error) {
+	info, err := c.InspectQueue(name)
+	if err != nil {
+		return 0, err
+	}
+	return info.Messages, c.broker.Delete(name)
+}
+
+// Publish appends the message to the queue named by the exchange.
+func (c *memConnection) Publish(exchange, _ string, body []byte) error {
+	return c.broker.Publish(exchange, body)
+}
+
+// Close ends the subscriptions of the connection.
+func (c *memConnection) Close() error {
+	c.closeAll()
+	return nil
+}
+
+// Messages ...
+func (s *memSubscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Close ...
+func (s *memSubscription) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		<-s.stopped
+		s.broker.detach(s)
+	})
+	return nil
+}
+
+// run delivers up to prefetch messages at a time and waits until all of
+// them are settled. Unacked and requeued messages are put back to the head
+// of the queue, rejected ones are discarded, there is no dead lettering.
+func (s *memSubscription) run() {
+	defer close(s.stopped)
+	defer close(s.messages)
+
+	for {
+		entries := s.broker.take(s.queue, s.prefetch)
+		if len(entries) == 0 {
+			select {
+			case <-s.queue.ready:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		batch := make([]*memMessage, len(entries))
+		for i, entry := range entries {
+			batch[i] = &memMessage{memEntry: entry, acked: make(chan struct{})}
+		}
+
+		for i, msg := range batch {
+			select {
+			case s.messages <- msg:
+			case <-s.done:
+				s.settle(batch, i)
+				return
+			}
+		}
+		for _, msg := range batch {
+			select {
+			case <-msg.acked:
+			case <-s.done:
+				s.settle(batch, len(batch))
+				return
+			}
+		}
+		s.settle(batch, len(batch))
+	}
+}
+
+// settle requeues the messages of a batch not acked or rejected, those
+// never handed out or left in the buffer do not count as delivered.
+func (s *memSubscription) settle(batch []*memMessage, sent int) {
+	buffered := map[*memMessage]bool{}
+	for {
+		select {
+		case msg := <-s.messages:
+			buffered[msg.(*memMessage)] = true
+			continue
+		default:
+		}
+		break
+	}
+
+	var entries []memEntry
+	for i, msg := range batch {
+		if i >= sent || buffered[msg] {
+			msg.deliveries--
+			entries = append(entries, msg.memEntry)
+			continue
+		}
+		select {
+		case <-msg.acked:
+			if msg.requeue {
+				entries = append(entries, msg.memEntry)
+			}
+		default:
+			entries = append(entries, msg.memEntry)
+		}
+	}
+	s.broker.requeue(s.queue, entries)
+}
+
+// ID ...
+func (m *memMessage) ID() string {
+	return ""
+}
+
+// Body ...
+func (m *memMessage) Body() []byte {
+	return m.body
+}
+
+// Deliveries ...
+func (m *memMessage) Deliveries() int {
+	return m.deliveries
+}
+
+// Timestamp returns the time of publishing, there are no headers.
+func (m *memMessage) Timestamp(string) time.Time {
+	return m.published
+}
+
+// Ack ...
+func (m *memMessage) Ack() error {
+	m.once.Do(func() { close(m.acked) })
+	return nil
+}
+
+// Nack ...
+func (m *memMessage) Nack(requeue bool) error {
+	m.once.Do(func() {
+		m.requeue = requeue
+		close(m.acked)
+	})
+	return nil
+}
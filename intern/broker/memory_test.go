@@ -0,0 +1,279 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+// testReceive returns the next message of the subscription, failing the
+// test when none arrives in time.
+func testReceive(t *testing.T, sub Subscription) Message {
+	select {
+	case msg := <-sub.Messages():
+		return msg
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected message")
+	}
+	return nil
+}
+
+// testEnded fails the test unless the subscription ends in time.
+func testEnded(t *testing.T, sub Subscription) {
+	select {
+	case _, ok := <-sub.Messages():
+		if ok {
+			t.Error("unexpected message")
+		}
+	case <-time.After(time.Second * 2):
+		t.Error("expected subscription ended")
+	}
+}
+
+// Must deliver published messages in order, one at a time
+func TestMemory_Subscribe_1(t *testing.T) {
+	conn, _ := DialMemory("memory://test-subscribe-1")
+	memory := OpenMemory("test-subscribe-1")
+
+	sub, err := conn.Subscribe("q", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sub.Close() }()
+
+	_ = memory.Publish("q", []byte("foo"))
+	_ = memory.Publish("q", []byte("bar"))
+
+	msg := testReceive(t, sub)
+	if string(msg.Body()) != "foo" {
+		t.Errorf("expected foo, got %s", msg.Body())
+	}
+
+	select {
+	case <-sub.Messages():
+		t.Error("unexpected delivery before ack")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	_ = msg.Ack()
+
+	msg = testReceive(t, sub)
+	if string(msg.Body()) != "bar" {
+		t.Errorf("expected bar, got %s", msg.Body())
+	}
+}
+
+// Must redeliver unacked message to the next consumer
+func TestMemory_Subscribe_2(t *testing.T) {
+	conn, _ := DialMemory("memory://test-subscribe-2")
+	memory := OpenMemory("test-subscribe-2")
+
+	_ = memory.Declare("q", 0)
+	_ = memory.Publish("q", []byte("foo"))
+
+	sub, _ := conn.Subscribe("q", Options{})
+	_ = testReceive(t, sub)
+	_ = sub.Close()
+
+	if _, ok := <-sub.Messages(); ok {
+		t.Error("expected closed message channel")
+	}
+
+	sub, _ = conn.Subscribe("q", Options{})
+	defer func() { _ = sub.Close() }()
+
+	msg := testReceive(t, sub)
+	if string(msg.Body()) != "foo" {
+		t.Errorf("expected foo, got %s", msg.Body())
+	}
+}
+
+// Must reject a second consumer
+func TestMemory_Subscribe_3(t *testing.T) {
+	conn, _ := DialMemory("memory://test-subscribe-3")
+
+	sub, _ := conn.Subscribe("q", Options{})
+	defer func() { _ = sub.Close() }()
+
+	if _, err := conn.Subscribe("q", Options{}); err != errMaxConsumers {
+		t.Errorf("expected %s, got %v", errMaxConsumers, err)
+	}
+}
+
+// Must not subscribe on closed connection
+func TestMemory_Subscribe_4(t *testing.T) {
+	conn, _ := DialMemory("memory://test-subscribe-4")
+	_ = conn.Close()
+
+	if _, err := conn.Subscribe("q", Options{}); err != errConnClosed {
+		t.Errorf("expected %s, got %v", errConnClosed, err)
+	}
+}
+
+// Must drop unused queue after expiry, but not while consumed
+func TestMemory_Expires(t *testing.T) {
+	conn, _ := DialMemory("memory://test-expires")
+	memory := OpenMemory("test-expires")
+
+	sub, _ := conn.Subscribe("q", Options{Expires: 1})
+	time.Sleep(time.Millisecond * 1500)
+
+	if err := memory.Publish("q", []byte("foo")); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	_ = sub.Close()
+	time.Sleep(time.Millisecond * 1500)
+
+	if err := memory.Publish("q", []byte("foo")); err != ErrNoQueue {
+		t.Errorf("expected %s, got %v", ErrNoQueue, err)
+	}
+}
+
+// Must cancel consumer of deleted queue
+func TestMemory_Delete(t *testing.T) {
+	conn, _ := DialMemory("memory://test-delete")
+	memory := OpenMemory("test-delete")
+
+	if err := memory.Delete("q"); err != ErrNoQueue {
+		t.Errorf("expected %s, got %v", ErrNoQueue, err)
+	}
+
+	sub, _ := conn.Subscribe("q", Options{})
+
+	if err := memory.Delete("q"); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if _, ok := <-sub.Messages(); ok {
+		t.Error("expected closed message channel")
+	}
+}
+
+// Must requeue nacked message at the head, count deliveries, drop rejected
+func TestMemory_Nack(t *testing.T) {
+	conn, _ := DialMemory("memory://test-nack")
+	memory := OpenMemory("test-nack")
+
+	sub, _ := conn.Subscribe("q", Options{})
+	defer func() { _ = sub.Close() }()
+
+	_ = memory.Publish("q", []byte("foo"))
+	_ = memory.Publish("q", []byte("bar"))
+
+	for i := 1; i <= 2; i++ {
+		msg := testReceive(t, sub)
+		if string(msg.Body()) != "foo" || msg.Deliveries() != i {
+			t.Errorf("unexpected message %s delivered %d times", msg.Body(), msg.Deliveries())
+		}
+		_ = msg.Nack(true)
+	}
+
+	_ = testReceive(t, sub).Nack(false)
+
+	msg := testReceive(t, sub)
+	if string(msg.Body()) != "bar" || msg.Deliveries() != 1 {
+		t.Errorf("unexpected message %s delivered %d times", msg.Body(), msg.Deliveries())
+	}
+}
+
+// Must deliver up to prefetch messages ahead, requeue unsettled in order
+func TestMemory_Prefetch(t *testing.T) {
+	conn, _ := DialMemory("memory://test-prefetch")
+	memory := OpenMemory("test-prefetch")
+
+	_ = memory.Declare("q", 0)
+	for _, body := range []string{"foo", "bar", "baz"} {
+		_ = memory.Publish("q", []byte(body))
+	}
+
+	sub, _ := conn.Subscribe("q", Options{Prefetch: 2})
+	foo := testReceive(t, sub)
+	bar := testReceive(t, sub)
+
+	select {
+	case <-sub.Messages():
+		t.Error("unexpected delivery beyond prefetch")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	_ = bar.Ack()
+	_ = sub.Close()
+
+	sub, _ = conn.Subscribe("q", Options{Prefetch: 2})
+	defer func() { _ = sub.Close() }()
+
+	for _, expect := range []string{"foo", "baz"} {
+		msg := testReceive(t, sub)
+		if string(msg.Body()) != expect {
+			t.Errorf("expected %s, got %s", expect, msg.Body())
+		}
+	}
+	if foo.Deliveries() != 1 {
+		t.Errorf("expected first delivery, got %d", foo.Deliveries())
+	}
+}
+
+// Must stamp messages with the time of publishing
+func TestMemory_Timestamp(t *testing.T) {
+	conn, _ := DialMemory("memory://test-timestamp")
+	memory := OpenMemory("test-timestamp")
+
+	sub, err := conn.Subscribe("q", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sub.Close() }()
+
+	before := time.Now()
+	_ = memory.Publish("q", []byte("foo"))
+
+	msg := testReceive(t, sub)
+	published := msg.(Timestamper).Timestamp("")
+
+	if published.Before(before) || published.After(time.Now()) {
+		t.Errorf("unexpected timestamp %s", published)
+	}
+}
+
+// Must declare, inspect, purge and delete queues
+func TestMemory_QueueManager(t *testing.T) {
+	conn, _ := DialMemory("memory://test-queue-manager")
+	memory := OpenMemory("test-queue-manager")
+
+	queues, ok := Queues(&nodeConnection{Connection: conn})
+	if !ok {
+		t.Fatal("expected queue manager")
+	}
+
+	if _, err := queues.InspectQueue("q"); err != ErrNoQueue {
+		t.Errorf("expected %s, got %v", ErrNoQueue, err)
+	}
+	if info, err := queues.DeclareQueue("q", Options{}); err != nil || info != (QueueInfo{Name: "q"}) {
+		t.Errorf("unexpected queue %v, %v", info, err)
+	}
+
+	_ = memory.Publish("q", []byte("foo"))
+	_ = memory.Publish("q", []byte("bar"))
+
+	sub, _ := conn.Subscribe("q", Options{})
+	_ = testReceive(t, sub)
+
+	if info, _ := queues.InspectQueue("q"); info != (QueueInfo{Name: "q", Messages: 1, Consumers: 1}) {
+		t.Errorf("unexpected queue %v", info)
+	}
+	if n, err := queues.PurgeQueue("q"); n != 1 || err != nil {
+		t.Errorf("expected 1 message purged, got %d, %v", n, err)
+	}
+	if n, err := queues.DeleteQueue("q"); n != 0 || err != nil {
+		t.Errorf("expected empty queue deleted, got %d, %v", n, err)
+	}
+	if _, ok := <-sub.Messages(); ok {
+		t.Error("expected consumer to be cancelled")
+	}
+	if _, err := queues.DeleteQueue("q"); err != ErrNoQueue {
+		t.Errorf("expected %s, got %v", ErrNoQueue, err)
+	}
+	if _, ok := Queues(&mqttConnection{}); ok {
+		t.Error("expected no queue manager")
+	}
+}
@@ -0,0 +1,162 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type (
+	// Message is a broker-neutral message received from a queue. Deliveries
+	// counts the delivery attempts including the current one, as far as the
+	// broker tracks them. Nack hands the message back for redelivery, or
+	// rejects it without requeue, so the broker may dead-letter it.
+	Message interface {
+		ID() string
+		Body() []byte
+		Deliveries() int
+		Ack() error
+		Nack(requeue bool) error
+	}
+
+	// MultiAcker is implemented by messages able to acknowledge all unacked
+	// messages of the subscription up to and including themselves at once.
+	MultiAcker interface {
+		AckMultiple() error
+	}
+
+	// Timestamper is implemented by messages carrying their publish time,
+	// taken from the named header when given. The zero time is returned
+	// when it is unknown.
+	Timestamper interface {
+		Timestamp(header string) time.Time
+	}
+
+	// HeaderReader is implemented by messages carrying headers, e.g. the
+	// W3C traceparent of the publisher.
+	HeaderReader interface {
+		Header(key string) string
+	}
+
+	// Subscription represents an active consumer of a single queue.
+	Subscription interface {
+		Messages() <-chan Message
+		Close() error
+	}
+
+	// notifier dispatches connection failures to registered listeners.
+	notifier struct {
+		mu  sync.Mutex
+		err map[chan error]bool
+	}
+
+	// tracker closes the subscriptions still open when the connection
+	// closes, for brokers that would keep them alive.
+	tracker struct {
+		mu     sync.Mutex
+		subs   map[*trackedSubscription]bool
+		closed bool
+	}
+	trackedSubscription struct {
+		Subscription
+		tracker *tracker
+	}
+)
+
+var errMaxConsumers = errors.New("server: max consumers exceeded")
+
+// Notify ...
+func (n *notifier) Notify(err chan error) chan error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.err == nil {
+		n.err = map[chan error]bool{}
+	}
+	n.err[err] = true
+	return err
+}
+
+// Ignore ...
+func (n *notifier) Ignore(err chan error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.err, err)
+}
+
+func (n *notifier) dispatch(err error) {
+	if err != nil {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		for listener := range n.err {
+			listener <- err
+		}
+	}
+}
+
+// track registers the subscription, which is closed right away when the
+// connection is closed already.
+func (t *tracker) track(sub Subscription) (Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		_ = sub.Close()
+		return nil, errConnClosed
+	}
+	if t.subs == nil {
+		t.subs = map[*trackedSubscription]bool{}
+	}
+	tracked := &trackedSubscription{Subscription: sub, tracker: t}
+	t.subs[tracked] = true
+	return tracked, nil
+}
+
+// closeAll closes the subscriptions, their messages channels are closed
+// so the streams consuming them end.
+func (t *tracker) closeAll() {
+	t.mu.Lock()
+	subs := t.subs
+	t.subs, t.closed = nil, true
+	t.mu.Unlock()
+
+	for sub := range subs {
+		_ = sub.Subscription.Close()
+	}
+}
+
+// Close ...
+func (s *trackedSubscription) Close() error {
+	s.tracker.mu.Lock()
+	delete(s.tracker.subs, s)
+	s.tracker.mu.Unlock()
+
+	return s.Subscription.Close()
+}
+
+// headerTime converts a timestamp header value, either a time, an RFC 3339
+// string or milliseconds since the epoch.
+func headerTime(value interface{}) time.Time {
+	switch v := value.(type) {
+	case time.Time:
+		return v
+	case int64:
+		return time.Unix(0, v*int64(time.Millisecond))
+	case int32:
+		return headerTime(int64(v))
+	case []byte:
+		return headerTime(string(v))
+	case string:
+		if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return headerTime(ms)
+		}
+		t, _ := time.Parse(time.RFC3339Nano, v)
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,32 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+// Must convert timestamp header values
+func TestMessage_HeaderTime(t *testing.T) {
+	expect := time.Date(2019, 3, 1, 12, 0, 0, 5e6, time.UTC)
+
+	samples := []interface{}{
+		expect,
+		int64(1551441600005),
+		"1551441600005",
+		[]byte("1551441600005"),
+		"2019-03-01T12:00:00.005Z",
+	}
+	for _, sample := range samples {
+		if result := headerTime(sample); !result.Equal(expect) {
+			t.Errorf("%v: expected %s, got %s", sample, expect, result)
+		}
+	}
+
+	for _, sample := range []interface{}{nil, "", "yesterday", 1.5} {
+		if result := headerTime(sample); !result.IsZero() {
+			t.Errorf("%v: expected zero time, got %s", sample, result)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+type (
+	mqttConnection struct {
+		notifier
+		tracker
+		broker string
+		tls    *tls.Config
+		probe  mqtt.Client
+	}
+	mqttSubscription struct {
+		client   mqtt.Client
+		clientID string
+		messages chan Message
+		done     chan struct{}
+		once     sync.Once
+		mu       sync.RWMutex
+	}
+	mqttMessage struct {
+		msg mqtt.Message
+	}
+)
+
+const (
+	mqttQoS     = 1
+	mqttTimeout = 5 * time.Second
+)
+
+var errTopic = errors.New("broker: invalid topic")
+
+// mqttSessions holds the client ids of the sessions in use by this process.
+// The broker would hand a session over to a second client of the same id,
+// ending the stream of the first one.
+var mqttSessions = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// DialMQTT is the Dialer for MQTT nodes, e.g. mqtt://host:1883. The schemes
+// mqtts, ssl and tls enable TLS, the optional query parameters ca, cert and
+// key denote PEM files for a custom CA and a client certificate.
+func DialMQTT(rawURL string) (Connection, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqttConnection{}
+	if c.tls, err = mqttTLS(u); err != nil {
+		return nil, err
+	}
+
+	u.RawQuery = ""
+	if c.tls != nil {
+		u.Scheme = "tls"
+	} else {
+		u.Scheme = "tcp"
+	}
+	c.broker = u.String()
+
+	// The probe detects connection loss when idle.
+	c.probe = mqtt.NewClient(c.options().
+		SetCleanSession(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			c.dispatch(err)
+		}),
+	)
+	if err = mqttWait(c.probe.Connect()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Subscribe connects a client with a persistent session keyed by the topic
+// and subscribes with QoS 1. A topic is consumed once per process, further
+// consumers are refused. A client of another process resuming the session
+// takes over, the previous consumer is disconnected by the broker then.
+func (c *mqttConnection) Subscribe(topic string, options Options) (Subscription, error) {
+	if !mqttTopic(topic) {
+		return nil, errTopic
+	}
+
+	s := &mqttSubscription{
+		clientID: mqttClientID(topic),
+		messages: make(chan Message, options.prefetch()),
+		done:     make(chan struct{}),
+	}
+	if !s.acquire() {
+		return nil, errMaxConsumers
+	}
+
+	// Queued messages of a resumed session arrive before the subscription
+	// is acknowledged, hence the default handler.
+	s.client = mqtt.NewClient(c.options().
+		SetClientID(s.clientID).
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(true).
+		SetDefaultPublishHandler(s.receive).
+		SetConnectionLostHandler(func(mqtt.Client, error) {
+			_ = s.Close()
+		}),
+	)
+
+	if err := mqttWait(s.client.Connect()); err != nil {
+		s.release()
+		return nil, err
+	}
+	if err := mqttWait(s.client.Subscribe(topic, mqttQoS, s.receive)); err != nil {
+		s.client.Disconnect(0)
+		s.release()
+		return nil, err
+	}
+	return c.track(s)
+}
+
+// Close ends the subscriptions of the connection.
+func (c *mqttConnection) Close() error {
+	c.closeAll()
+	c.probe.Disconnect(250)
+	return nil
+}
+
+func (c *mqttConnection) options() *mqtt.ClientOptions {
+	return mqtt.NewClientOptions().
+		AddBroker(c.broker).
+		SetTLSConfig(c.tls).
+		SetAutoReconnect(false).
+		SetConnectTimeout(mqttTimeout)
+}
+
+// Messages ...
+func (s *mqttSubscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Close disconnects without unsubscribing, the session is kept by the
+// broker and unacked messages are redelivered on resumption.
+func (s *mqttSubscription) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		close(s.messages)
+		s.mu.Unlock()
+
+		go s.client.Disconnect(250)
+		s.release()
+	})
+	return nil
+}
+
+// acquire reserves the session for this subscription, false when in use.
+func (s *mqttSubscription) acquire() bool {
+	mqttSessions.Lock()
+	defer mqttSessions.Unlock()
+
+	if mqttSessions.m[s.clientID] {
+		return false
+	}
+	mqttSessions.m[s.clientID] = true
+	return true
+}
+
+func (s *mqttSubscription) release() {
+	mqttSessions.Lock()
+	defer mqttSessions.Unlock()
+
+	delete(mqttSessions.m, s.clientID)
+}
+
+func (s *mqttSubscription) receive(_ mqtt.Client, msg mqtt.Message) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	select {
+	case s.messages <- &mqttMessage{msg}:
+	case <-s.done:
+	}
+}
+
+// ID ...
+func (m *mqttMessage) ID() string {
+	return ""
+}
+
+// Body ...
+func (m *mqttMessage) Body() []byte {
+	return m.msg.Payload()
+}
+
+// Deliveries reports a redelivery by the DUP flag only.
+func (m *mqttMessage) Deliveries() int {
+	if m.msg.Duplicate() {
+		return 2
+	}
+	return 1
+}
+
+// Ack ...
+func (m *mqttMessage) Ack() error {
+	m.msg.Ack()
+	return nil
+}
+
+// Nack leaves a requeued message unacknowledged, it is redelivered when
+// the session is resumed. MQTT lacks dead lettering, so a rejected message
+// is acknowledged and dropped.
+func (m *mqttMessage) Nack(requeue bool) error {
+	if !requeue {
+		m.msg.Ack()
+	}
+	return nil
+}
+
+func mqttWait(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttTimeout) {
+		return errors.New("broker: mqtt timeout")
+	}
+	return token.Error()
+}
+
+func mqttTLS(u *url.URL) (*tls.Config, error) {
+	switch u.Scheme {
+	case "mqtts", "ssl", "tls":
+	default:
+		return nil, nil
+	}
+
+	query := u.Query()
+	config := &tls.Config{ServerName: u.Hostname()}
+
+	if ca := query.Get("ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("broker: no certificate in " + ca)
+		}
+	}
+	if cert := query.Get("cert"); cert != "" {
+		pair, err := tls.LoadX509KeyPair(cert, query.Get("key"))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// mqttTopic reports whether name is a plain topic, wildcards would let
+// clients tap into foreign topics.
+func mqttTopic(name string) bool {
+	return name != "" &&
+		!strings.HasPrefix(name, "$") &&
+		!strings.ContainsAny(name, "+#\x00")
+}
+
+// mqttClientID derives a client id from the topic, fitting the 23 byte
+// limit of MQTT 3.1.1.
+func mqttClientID(topic string) string {
+	sum := sha256.Sum256([]byte(topic))
+	return "es" + hex.EncodeToString(sum[:])[:21]
+}
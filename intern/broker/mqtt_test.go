@@ -0,0 +1,138 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+func testMQTT(t *testing.T) (*mqtt.Server, Connection) {
+	srv := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+	})
+	_ = srv.AddHook(new(auth.AllowHook), nil)
+
+	tcp := listeners.NewTCP(listeners.Config{ID: "t", Address: "127.0.0.1:0"})
+	if err := srv.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve() }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	conn, err := DialMQTT("mqtt://" + tcp.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return srv, conn
+}
+
+// Must deliver messages and resume the persistent session
+func TestMQTT_Subscribe_1(t *testing.T) {
+	srv, conn := testMQTT(t)
+
+	sub, err := conn.Subscribe("devices/42/telemetry", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = srv.Publish("devices/42/telemetry", []byte("foo"), false, 1)
+
+	msg := testReceive(t, sub)
+	if string(msg.Body()) != "foo" {
+		t.Errorf("expected foo, got %s", msg.Body())
+	}
+	_ = msg.Ack()
+	_ = sub.Close()
+
+	if _, ok := <-sub.Messages(); ok {
+		t.Error("expected closed message channel")
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	_ = srv.Publish("devices/42/telemetry", []byte("bar"), false, 1)
+
+	sub, err = conn.Subscribe("devices/42/telemetry", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sub.Close() }()
+
+	msg = testReceive(t, sub)
+	if string(msg.Body()) != "bar" {
+		t.Errorf("expected bar, got %s", msg.Body())
+	}
+	_ = msg.Ack()
+}
+
+// Must reject wildcard and system topics
+func TestMQTT_Subscribe_2(t *testing.T) {
+	_, conn := testMQTT(t)
+
+	for _, topic := range []string{"", "devices/+", "devices/#", "$SYS/uptime"} {
+		if _, err := conn.Subscribe(topic, Options{}); err != errTopic {
+			t.Errorf("expected %s, got %v", errTopic, err)
+		}
+	}
+}
+
+// Must refuse a second consumer of a topic
+func TestMQTT_Subscribe_3(t *testing.T) {
+	_, conn := testMQTT(t)
+
+	sub, err := conn.Subscribe("devices/43/telemetry", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Subscribe("devices/43/telemetry", Options{}); err != errMaxConsumers {
+		t.Errorf("expected %s, got %v", errMaxConsumers, err)
+	}
+	_ = sub.Close()
+
+	if sub, err = conn.Subscribe("devices/43/telemetry", Options{}); err != nil {
+		t.Fatalf("expected session released, got %v", err)
+	}
+	_ = sub.Close()
+}
+
+// Must end the subscriptions of a closed connection, releasing sessions
+func TestMQTT_Close(t *testing.T) {
+	_, conn := testMQTT(t)
+
+	sub, err := conn.Subscribe("devices/44/telemetry", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.Close()
+	testEnded(t, sub)
+
+	session := &mqttSubscription{clientID: mqttClientID("devices/44/telemetry")}
+	if !session.acquire() {
+		t.Fatal("expected session released")
+	}
+	session.release()
+
+	if _, err = conn.Subscribe("devices/44/telemetry", Options{}); err == nil {
+		t.Error("expected closed connection")
+	}
+}
+
+// Must fail dialing unreachable node and broken TLS setup
+func TestMQTT_Dial(t *testing.T) {
+	if _, err := DialMQTT("mqtt://127.0.0.1:1"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := DialMQTT("mqtts://127.0.0.1:1?ca=/not/here"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,310 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type (
+	natsConnection struct {
+		notifier
+		tracker
+		conn *nats.Conn
+		js   nats.JetStreamContext
+	}
+	natsSubscription struct {
+		sub      *nats.Subscription
+		lastID   uint64
+		messages chan Message
+		done     chan struct{}
+		once     sync.Once
+		// sending guards messages against being closed during a send.
+		sending sync.RWMutex
+
+		mu       sync.Mutex
+		inFlight map[*nats.Msg]bool
+	}
+	natsMessage struct {
+		msg        *nats.Msg
+		sub        *natsSubscription
+		id         string
+		deliveries int
+		published  time.Time
+	}
+)
+
+var errSubject = errors.New("broker: invalid subject")
+
+// DialNATS is the Dialer for core NATS nodes, e.g. nats://host:4222. The
+// queue name is taken as subject, messages fan out to every subscriber
+// and are neither persisted nor acknowledged.
+func DialNATS(url string) (Connection, error) {
+	return dialNATS(url, false)
+}
+
+// DialJetStream is the Dialer for NATS JetStream nodes. The queue name is
+// taken as subject, each client consumes through a durable consumer on
+// the stream that holds the subject.
+func DialJetStream(url string) (Connection, error) {
+	return dialNATS(url, true)
+}
+
+func dialNATS(url string, jetStream bool) (Connection, error) {
+	c := &natsConnection{}
+
+	conn, err := nats.Connect(url,
+		nats.Name("eventsourced"),
+		nats.ClosedHandler(func(conn *nats.Conn) {
+			c.dispatch(conn.LastError())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	if jetStream {
+		if c.js, err = conn.JetStream(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Publish sends the message to the subject exchange.key, also to streams
+// of JetStream capturing it.
+func (c *natsConnection) Publish(exchange, key string, body []byte) error {
+	subject := exchange + "." + key
+	if !natsSubject(subject) {
+		return errSubject
+	}
+	return c.conn.Publish(subject, body)
+}
+
+// Subscribe ...
+func (c *natsConnection) Subscribe(name string, options Options) (Subscription, error) {
+	if !natsSubject(name) {
+		return nil, errSubject
+	}
+
+	s := &natsSubscription{
+		messages: make(chan Message, options.prefetch()),
+		done:     make(chan struct{}),
+		inFlight: map[*nats.Msg]bool{},
+	}
+
+	var err error
+	if c.js == nil {
+		s.sub, err = c.conn.Subscribe(name, s.receive)
+	} else {
+		s.lastID, _ = strconv.ParseUint(options.LastID, 10, 64)
+		err = c.consume(s, name, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = c.conn.Flush(); err != nil {
+		_ = s.sub.Unsubscribe()
+		return nil, err
+	}
+	return c.track(s)
+}
+
+// consume binds to the durable consumer of the subject or creates it. New
+// consumers start after lastID when given, else with upcoming messages.
+// The consumer is created upfront, since unsubscribing would delete it.
+// Its MaxAckPending is the prefetch at creation time.
+func (c *natsConnection) consume(s *natsSubscription, subject string, options Options) error {
+	stream, err := c.js.StreamNameBySubject(subject)
+	if err != nil {
+		return err
+	}
+	durable := natsDurable(subject)
+
+	info, err := c.js.ConsumerInfo(stream, durable)
+	if err != nil && !errors.Is(err, nats.ErrConsumerNotFound) {
+		return err
+	}
+	if err == nil && info.PushBound {
+		return errMaxConsumers
+	}
+
+	if err != nil {
+		config := &nats.ConsumerConfig{
+			Durable:           durable,
+			DeliverSubject:    nats.NewInbox(),
+			DeliverPolicy:     nats.DeliverNewPolicy,
+			AckPolicy:         nats.AckExplicitPolicy,
+			MaxAckPending:     options.prefetch(),
+			FilterSubject:     subject,
+			InactiveThreshold: time.Duration(options.Expires) * time.Second,
+		}
+		if s.lastID > 0 {
+			config.DeliverPolicy = nats.DeliverByStartSequencePolicy
+			config.OptStartSeq = s.lastID + 1
+		}
+		if _, err = c.js.AddConsumer(stream, config); err != nil {
+			return err
+		}
+	}
+
+	s.sub, err = c.js.Subscribe(subject, s.receive, nats.Bind(stream, durable), nats.ManualAck())
+	return err
+}
+
+// Close ends the subscriptions of the connection.
+func (c *natsConnection) Close() error {
+	c.closeAll()
+	c.conn.Close()
+	return nil
+}
+
+// Messages ...
+func (s *natsSubscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Close unsubscribes, unacked messages are handed back for redelivery.
+func (s *natsSubscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.sub.Unsubscribe()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for msg := range s.inFlight {
+			_ = msg.Nak()
+		}
+
+		s.sending.Lock()
+		close(s.messages)
+		s.sending.Unlock()
+	})
+	return err
+}
+
+func (s *natsSubscription) receive(msg *nats.Msg) {
+	var id string
+	var published time.Time
+	deliveries := 1
+
+	if meta, err := msg.Metadata(); err == nil {
+		if meta.Sequence.Stream <= s.lastID {
+			_ = msg.Ack()
+			return
+		}
+		id = strconv.FormatUint(meta.Sequence.Stream, 10)
+		deliveries = int(meta.NumDelivered)
+		published = meta.Timestamp
+
+		s.mu.Lock()
+		s.inFlight[msg] = true
+		s.mu.Unlock()
+	}
+
+	s.sending.RLock()
+	defer s.sending.RUnlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	select {
+	case s.messages <- &natsMessage{msg: msg, sub: s, id: id, deliveries: deliveries, published: published}:
+	case <-s.done:
+	}
+}
+
+// ID returns the stream sequence of JetStream messages.
+func (m *natsMessage) ID() string {
+	return m.id
+}
+
+// Body ...
+func (m *natsMessage) Body() []byte {
+	return m.msg.Data
+}
+
+// Deliveries ...
+func (m *natsMessage) Deliveries() int {
+	return m.deliveries
+}
+
+// Timestamp returns the time of the header given, or the time JetStream
+// stored the message.
+func (m *natsMessage) Timestamp(header string) time.Time {
+	if header != "" {
+		return headerTime(m.msg.Header.Get(header))
+	}
+	return m.published
+}
+
+// Header ...
+func (m *natsMessage) Header(key string) string {
+	return m.msg.Header.Get(key)
+}
+
+// Ack ...
+func (m *natsMessage) Ack() error {
+	if m.id == "" {
+		return nil
+	}
+	m.settle()
+	return m.msg.Ack()
+}
+
+// Nack naks a requeued JetStream message and terminates a rejected one,
+// which raises a MSG_TERMINATED advisory for dead letter handling. Core
+// NATS messages are not acknowledged at all.
+func (m *natsMessage) Nack(requeue bool) error {
+	if m.id == "" {
+		return nil
+	}
+	m.settle()
+
+	if requeue {
+		return m.msg.Nak()
+	}
+	return m.msg.Term()
+}
+
+func (m *natsMessage) settle() {
+	m.sub.mu.Lock()
+	defer m.sub.mu.Unlock()
+
+	delete(m.sub.inFlight, m.msg)
+}
+
+// natsSubject reports whether name is a literal subject, wildcards would
+// let clients tap into foreign subjects.
+func natsSubject(name string) bool {
+	if strings.ContainsAny(name, "*> \t\r\n") {
+		return false
+	}
+	for _, token := range strings.Split(name, ".") {
+		if token == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// natsDurable derives a valid durable consumer name from the subject.
+func natsDurable(subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return "eventsourced_" + hex.EncodeToString(sum[:12])
+}
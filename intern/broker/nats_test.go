@@ -0,0 +1,214 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func testNATS(t *testing.T) (*server.Server, *nats.Conn) {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	t.Cleanup(srv.Shutdown)
+
+	if !srv.ReadyForConnections(time.Second * 5) {
+		t.Fatal("nats server not ready")
+	}
+
+	conn, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+
+	js, _ := conn.JetStream()
+	if _, err = js.AddStream(&nats.StreamConfig{
+		Name:     "EVENTS",
+		Subjects: []string{"events.>"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return srv, conn
+}
+
+// Must fan out core NATS messages to every subscriber
+func TestNATS_Subscribe_1(t *testing.T) {
+	srv, nc := testNATS(t)
+
+	conn, err := DialNATS(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	sub1, _ := conn.Subscribe("news.all", Options{})
+	defer func() { _ = sub1.Close() }()
+	sub2, _ := conn.Subscribe("news.all", Options{})
+	defer func() { _ = sub2.Close() }()
+
+	_ = nc.Publish("news.all", []byte("foo"))
+
+	for _, sub := range []Subscription{sub1, sub2} {
+		msg := testReceive(t, sub)
+		if string(msg.Body()) != "foo" || msg.ID() != "" {
+			t.Errorf("unexpected message %s %s", msg.ID(), msg.Body())
+		}
+		if err := msg.Ack(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// Must end the subscriptions of a closed connection
+func TestNATS_Close(t *testing.T) {
+	srv, _ := testNATS(t)
+
+	conn, err := DialNATS(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := conn.Subscribe("news.all", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sub.Close() }()
+
+	_ = conn.Close()
+	testEnded(t, sub)
+
+	if _, err = conn.Subscribe("news.all", Options{}); err == nil {
+		t.Error("expected closed connection")
+	}
+}
+
+// Must resume durable JetStream consumer, redeliver unacked messages
+func TestNATS_Subscribe_2(t *testing.T) {
+	srv, nc := testNATS(t)
+	js, _ := nc.JetStream()
+
+	conn, err := DialJetStream(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	sub, err := conn.Subscribe("events.q", Options{Expires: 1800})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = js.Publish("events.q", []byte("foo"))
+	_, _ = js.Publish("events.q", []byte("bar"))
+
+	msg := testReceive(t, sub)
+	if string(msg.Body()) != "foo" || msg.ID() != "1" {
+		t.Errorf("unexpected message %s %s", msg.ID(), msg.Body())
+	}
+	_ = sub.Close()
+
+	sub, err = conn.Subscribe("events.q", Options{Expires: 1800})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = testReceive(t, sub)
+	if string(msg.Body()) != "foo" {
+		t.Errorf("expected redelivery, got %s", msg.Body())
+	}
+	_ = sub.Close()
+
+	sub, err = conn.Subscribe("events.q", Options{Expires: 1800, LastID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sub.Close() }()
+
+	msg = testReceive(t, sub)
+	if string(msg.Body()) != "bar" || msg.ID() != "2" {
+		t.Errorf("unexpected message %s %s", msg.ID(), msg.Body())
+	}
+	_ = msg.Ack()
+}
+
+// Must reject a second JetStream consumer and wildcard subjects
+func TestNATS_Subscribe_3(t *testing.T) {
+	srv, _ := testNATS(t)
+
+	conn, _ := DialJetStream(srv.ClientURL())
+	defer func() { _ = conn.Close() }()
+
+	sub, _ := conn.Subscribe("events.q", Options{Expires: 1800})
+	defer func() { _ = sub.Close() }()
+
+	if _, err := conn.Subscribe("events.q", Options{Expires: 1800}); err != errMaxConsumers {
+		t.Errorf("expected %s, got %v", errMaxConsumers, err)
+	}
+
+	for _, subject := range []string{"events.*", "events.>", "events..q", "events q"} {
+		if _, err := conn.Subscribe(subject, Options{Expires: 1800}); err != errSubject {
+			t.Errorf("expected %s, got %v", errSubject, err)
+		}
+	}
+}
+
+// Must redeliver naked JetStream message and count deliveries
+func TestNATS_Nack(t *testing.T) {
+	srv, nc := testNATS(t)
+	js, _ := nc.JetStream()
+
+	conn, _ := DialJetStream(srv.ClientURL())
+	defer func() { _ = conn.Close() }()
+
+	sub, _ := conn.Subscribe("events.q", Options{Expires: 1800})
+	defer func() { _ = sub.Close() }()
+
+	_, _ = js.Publish("events.q", []byte("foo"))
+
+	for i := 1; i <= 2; i++ {
+		msg := testReceive(t, sub)
+		if string(msg.Body()) != "foo" || msg.Deliveries() != i {
+			t.Errorf("unexpected message %s delivered %d times", msg.Body(), msg.Deliveries())
+		}
+		_ = msg.Nack(true)
+	}
+
+	if err := testReceive(t, sub).Nack(false); err != nil {
+		t.Error(err)
+	}
+}
+
+// Must publish to the subject exchange.key
+func TestNATS_Publish(t *testing.T) {
+	srv, nc := testNATS(t)
+
+	conn, err := DialNATS(srv.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	sub, _ := nc.SubscribeSync("presence.connected")
+	_ = nc.Flush()
+
+	if err = Unwrap(conn).(Publisher).Publish("presence", "connected", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := sub.NextMsg(time.Second); err != nil || string(msg.Data) != "{}" {
+		t.Errorf("unexpected message %v, %v", msg, err)
+	}
+	if err = conn.(Publisher).Publish("presence", "*", nil); err != errSubject {
+		t.Errorf("expected %s, got %v", errSubject, err)
+	}
+}
@@ -0,0 +1,20 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+// Publisher is implemented by connections able to publish messages. The
+// exchange and routing key map to the addressing of the broker type: the
+// AMQP exchange and routing key, the memory queue or Redis stream named by
+// the exchange, the NATS subject exchange.key.
+type Publisher interface {
+	Publish(exchange, key string, body []byte) error
+}
+
+// Unwrap returns the connection of the broker type, also of one yielded
+// by a Connector, to probe for optional interfaces.
+func Unwrap(conn Connection) Connection {
+	if c, ok := conn.(*nodeConnection); ok {
+		return c.Connection
+	}
+	return conn
+}
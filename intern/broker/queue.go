@@ -0,0 +1,37 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"errors"
+)
+
+type (
+	// QueueManager is implemented by connections able to manage queues
+	// apart from consuming them. DeclareQueue creates the queue with the
+	// expiry of the options unless it exists, PurgeQueue and DeleteQueue
+	// return the number of messages dropped.
+	QueueManager interface {
+		DeclareQueue(name string, options Options) (QueueInfo, error)
+		InspectQueue(name string) (QueueInfo, error)
+		PurgeQueue(name string) (int, error)
+		DeleteQueue(name string) (int, error)
+	}
+
+	// QueueInfo tells the ready messages and consumers of a queue.
+	QueueInfo struct {
+		Name      string `json:"name"`
+		Messages  int    `json:"messages"`
+		Consumers int    `json:"consumers"`
+	}
+)
+
+// ErrNoQueue is returned for operations on a queue not declared.
+var ErrNoQueue = errors.New("broker: no such queue")
+
+// Queues returns the QueueManager of a connection, also of one yielded by
+// a Connector, false when the broker type does not support it.
+func Queues(conn Connection) (QueueManager, bool) {
+	m, ok := Unwrap(conn).(QueueManager)
+	return m, ok
+}
@@ -0,0 +1,460 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	redisConnection struct {
+		notifier
+		pool *redis.Pool
+		done chan struct{}
+		once sync.Once
+	}
+	redisSubscription struct {
+		pool     *redis.Pool
+		stream   string
+		expires  int
+		prefetch int
+		lastID   string
+		token    string
+		messages chan Message
+		done     chan struct{}
+		stopped  chan struct{}
+		once     sync.Once
+	}
+	redisEntry struct {
+		id   string
+		body []byte
+	}
+	redisMessage struct {
+		redisEntry
+		sub        *redisSubscription
+		deliveries int
+		acked      chan struct{}
+		once       sync.Once
+		requeue    bool
+		err        error
+	}
+)
+
+const (
+	redisGroup    = "eventsourced"
+	redisConsumer = "eventsourced"
+	redisField    = "data"
+	redisBlock    = 1000 // milliseconds
+	redisLockTTL  = 10 * time.Second
+	redisPing     = 5 * time.Second
+)
+
+// redisUnlock releases the consumer lock only when still held by us.
+var redisUnlock = redis.NewScript(1, `
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+	return 0
+`)
+
+// redisRenew extends the consumer lock only when still held by us.
+var redisRenew = redis.NewScript(1, `
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	end
+	return 0
+`)
+
+// DialRedis is the Dialer for Redis nodes, e.g. redis://:secret@host:6379/0.
+// Queues map to streams, consumed through a consumer group.
+func DialRedis(url string) (Connection, error) {
+	pool := &redis.Pool{
+		Dial:        func() (redis.Conn, error) { return redis.DialURL(url) },
+		MaxIdle:     8,
+		IdleTimeout: time.Minute,
+	}
+
+	conn := pool.Get()
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Do("PING"); err != nil {
+		_ = pool.Close()
+		return nil, err
+	}
+
+	c := &redisConnection{pool: pool, done: make(chan struct{})}
+	go c.observe()
+	return c, nil
+}
+
+// observe pings the node to detect connection loss when idle.
+func (c *redisConnection) observe() {
+	ticker := time.NewTicker(redisPing)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			conn := c.pool.Get()
+			_, err := conn.Do("PING")
+			_ = conn.Close()
+
+			if err != nil {
+				_ = c.Close()
+				c.dispatch(err)
+				return
+			}
+		}
+	}
+}
+
+// Subscribe creates the stream and its consumer group unless they exist.
+// Pending entries up to LastID are considered delivered and acknowledged.
+func (c *redisConnection) Subscribe(name string, options Options) (Subscription, error) {
+	conn := c.pool.Get()
+	defer func() { _ = conn.Close() }()
+
+	token := strconv.FormatUint(rand.Uint64(), 36)
+	lockTTL := int64(redisLockTTL / time.Millisecond)
+
+	_, err := redis.String(conn.Do("SET", redisLock(name), token, "NX", "PX", lockTTL))
+	if err == redis.ErrNil {
+		return nil, errMaxConsumers
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &redisSubscription{
+		pool:     c.pool,
+		stream:   name,
+		expires:  options.Expires,
+		prefetch: options.prefetch(),
+		lastID:   options.LastID,
+		token:    token,
+		messages: make(chan Message, options.prefetch()),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	_, err = conn.Do("XGROUP", "CREATE", name, redisGroup, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		s.release(conn)
+		return nil, err
+	}
+	s.renew(conn)
+
+	go s.run()
+	go s.keepAlive()
+	return s, nil
+}
+
+// Publish appends the message to the stream named by the exchange, the
+// key is added as type field.
+func (c *redisConnection) Publish(exchange, key string, body []byte) error {
+	conn := c.pool.Get()
+	defer func() { _ = conn.Close() }()
+
+	_, err := conn.Do("XADD", exchange, "*", "type", key, redisField, body)
+	return err
+}
+
+// Close ...
+func (c *redisConnection) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.pool.Close()
+	})
+	return err
+}
+
+// Messages ...
+func (s *redisSubscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Close ...
+func (s *redisSubscription) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		<-s.stopped
+
+		conn := s.pool.Get()
+		defer func() { _ = conn.Close() }()
+		s.release(conn)
+	})
+	return nil
+}
+
+// run reads pending entries first, then waits for new ones. It delivers
+// up to prefetch entries at a time and waits until all of them are settled,
+// requeued entries are read from the pending entries again.
+func (s *redisSubscription) run() {
+	defer close(s.stopped)
+	defer close(s.messages)
+
+	conn := s.pool.Get()
+	defer func() { _ = conn.Close() }()
+
+	start := "0"
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		args := []interface{}{"GROUP", redisGroup, redisConsumer, "COUNT", s.prefetch}
+		if start == ">" {
+			args = append(args, "BLOCK", redisBlock)
+		}
+		args = append(args, "STREAMS", s.stream, start)
+
+		entries, err := redisEntries(conn.Do("XREADGROUP", args...))
+		if err != nil {
+			return
+		}
+		if len(entries) == 0 {
+			start = ">"
+			continue
+		}
+
+		var batch []*redisMessage
+		for _, entry := range entries {
+			if start == "0" && (entry.body == nil || !redisAfter(entry.id, s.lastID)) {
+				_ = s.ack(entry.id)
+				continue
+			}
+			msg := &redisMessage{sub: s, redisEntry: entry, deliveries: 1, acked: make(chan struct{})}
+			if start == "0" {
+				msg.deliveries = s.deliveries(conn, entry.id)
+			}
+			batch = append(batch, msg)
+		}
+
+		for _, msg := range batch {
+			select {
+			case s.messages <- msg:
+			case <-s.done:
+				return
+			}
+		}
+		for _, msg := range batch {
+			select {
+			case <-msg.acked:
+				if msg.requeue {
+					start = "0"
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// keepAlive renews the consumer lock and the stream expiry.
+func (s *redisSubscription) keepAlive() {
+	ticker := time.NewTicker(redisLockTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			conn := s.pool.Get()
+			s.renew(conn)
+			_ = conn.Close()
+		}
+	}
+}
+
+func (s *redisSubscription) renew(conn redis.Conn) {
+	lockTTL := int64(redisLockTTL / time.Millisecond)
+	_, _ = redisRenew.Do(conn, redisLock(s.stream), s.token, lockTTL)
+	s.expire(conn)
+}
+
+func (s *redisSubscription) release(conn redis.Conn) {
+	_, _ = redisUnlock.Do(conn, redisLock(s.stream), s.token)
+	s.expire(conn)
+}
+
+func (s *redisSubscription) expire(conn redis.Conn) {
+	if s.expires > 0 {
+		_, _ = conn.Do("EXPIRE", s.stream, s.expires)
+	}
+}
+
+// deliveries returns the delivery count of a pending entry, which Redis
+// increments on reading the pending entries as well.
+func (s *redisSubscription) deliveries(conn redis.Conn, id string) int {
+	pending, err := redis.Values(conn.Do("XPENDING", s.stream, redisGroup, id, id, 1))
+	if err != nil || len(pending) == 0 {
+		return 1
+	}
+	entry, err := redis.Values(pending[0], nil)
+	if err != nil || len(entry) != 4 {
+		return 1
+	}
+	count, _ := redis.Int(entry[3], nil)
+	return count
+}
+
+// deadLetter moves the entry to the dead letter stream of the stream.
+func (s *redisSubscription) deadLetter(id string, body []byte) error {
+	conn := s.pool.Get()
+	_, err := conn.Do("XADD", redisDead(s.stream), "*", redisField, body)
+	_ = conn.Close()
+
+	if err != nil {
+		return err
+	}
+	return s.ack(id)
+}
+
+// ack acknowledges and removes the entry, the stream acts as a queue.
+func (s *redisSubscription) ack(id string) error {
+	conn := s.pool.Get()
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Do("XACK", s.stream, redisGroup, id); err != nil {
+		return err
+	}
+	_, err := conn.Do("XDEL", s.stream, id)
+	return err
+}
+
+// ID returns the stream entry id.
+func (m *redisMessage) ID() string {
+	return m.id
+}
+
+// Body ...
+func (m *redisMessage) Body() []byte {
+	return m.body
+}
+
+// Deliveries ...
+func (m *redisMessage) Deliveries() int {
+	return m.deliveries
+}
+
+// Timestamp is taken from the stream entry id, which holds the time of
+// adding for ids generated by Redis. There are no headers.
+func (m *redisMessage) Timestamp(string) time.Time {
+	ms, _ := redisSplit(m.id)
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+// Ack ...
+func (m *redisMessage) Ack() error {
+	m.once.Do(func() {
+		m.err = m.sub.ack(m.id)
+		close(m.acked)
+	})
+	return m.err
+}
+
+// Nack keeps a requeued entry pending, a rejected one is moved to the dead
+// letter stream eventsourced:dead:<stream>.
+func (m *redisMessage) Nack(requeue bool) error {
+	m.once.Do(func() {
+		m.requeue = requeue
+		if !requeue {
+			m.err = m.sub.deadLetter(m.id, m.body)
+		}
+		close(m.acked)
+	})
+	return m.err
+}
+
+func redisLock(stream string) string {
+	return "eventsourced:lock:" + stream
+}
+
+func redisDead(stream string) string {
+	return "eventsourced:dead:" + stream
+}
+
+// redisEntries extracts the entries from an XREADGROUP reply. The body
+// is the value of the "data" field, or of the first field when missing.
+func redisEntries(reply interface{}, err error) ([]redisEntry, error) {
+	streams, err := redis.Values(reply, err)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []redisEntry
+	for _, stream := range streams {
+		kv, err := redis.Values(stream, nil)
+		if err != nil || len(kv) != 2 {
+			return nil, err
+		}
+		entries, err := redis.Values(kv[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			e, err := redis.Values(entry, nil)
+			if err != nil || len(e) != 2 {
+				return nil, err
+			}
+			id, err := redis.String(e[0], nil)
+			if err != nil {
+				return nil, err
+			}
+			fields, _ := redis.ByteSlices(e[1], nil)
+			result = append(result, redisEntry{id: id, body: redisBody(fields)})
+		}
+	}
+	return result, nil
+}
+
+func redisBody(fields [][]byte) []byte {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if string(fields[i]) == redisField {
+			return fields[i+1]
+		}
+	}
+	if len(fields) > 1 {
+		return fields[1]
+	}
+	return nil
+}
+
+// redisAfter reports whether stream entry id a is newer than b.
+func redisAfter(a, b string) bool {
+	if b == "" {
+		return true
+	}
+	ams, aseq := redisSplit(a)
+	bms, bseq := redisSplit(b)
+
+	if ams != bms {
+		return ams > bms
+	}
+	return aseq > bseq
+}
+
+func redisSplit(id string) (uint64, uint64) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, _ := strconv.ParseUint(parts[0], 10, 64)
+	if len(parts) < 2 {
+		return ms, 0
+	}
+	seq, _ := strconv.ParseUint(parts[1], 10, 64)
+	return ms, seq
+}
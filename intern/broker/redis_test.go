@@ -0,0 +1,214 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func testRedis(t *testing.T) (*miniredis.Miniredis, Connection) {
+	server := miniredis.RunT(t)
+
+	conn, err := DialRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return server, conn
+}
+
+// Must deliver stream entries with their id and remove them on ack
+func TestRedis_Subscribe_1(t *testing.T) {
+	server, conn := testRedis(t)
+
+	sub, err := conn.Subscribe("q", Options{Expires: 1800})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sub.Close() }()
+
+	id, _ := server.XAdd("q", "*", []string{"data", "foo"})
+
+	msg := testReceive(t, sub)
+	if msg.ID() != id || string(msg.Body()) != "foo" {
+		t.Errorf("unexpected message %s %s", msg.ID(), msg.Body())
+	}
+	if err := msg.Ack(); err != nil {
+		t.Error(err)
+	}
+
+	entries, _ := server.Stream("q")
+	if len(entries) != 0 {
+		t.Errorf("expected empty stream, got %d entries", len(entries))
+	}
+	if server.TTL("q") != time.Second*1800 {
+		t.Errorf("expected stream TTL, got %s", server.TTL("q"))
+	}
+}
+
+// Must redeliver pending entries after lastID to the next consumer
+func TestRedis_Subscribe_2(t *testing.T) {
+	server, conn := testRedis(t)
+
+	sub, _ := conn.Subscribe("q", Options{Expires: 1800})
+
+	id1, _ := server.XAdd("q", "*", []string{"data", "foo"})
+	_ = testReceive(t, sub)
+	_ = sub.Close()
+
+	sub, _ = conn.Subscribe("q", Options{Expires: 1800})
+
+	msg := testReceive(t, sub)
+	if msg.ID() != id1 {
+		t.Errorf("expected redelivery of %s, got %s", id1, msg.ID())
+	}
+	_ = sub.Close()
+
+	id2, _ := server.XAdd("q", "*", []string{"data", "bar"})
+
+	sub, _ = conn.Subscribe("q", Options{Expires: 1800, LastID: id1})
+	defer func() { _ = sub.Close() }()
+
+	msg = testReceive(t, sub)
+	if msg.ID() != id2 {
+		t.Errorf("expected %s, got %s", id2, msg.ID())
+	}
+}
+
+// Must reject a second consumer
+func TestRedis_Subscribe_3(t *testing.T) {
+	_, conn := testRedis(t)
+
+	sub, _ := conn.Subscribe("q", Options{Expires: 1800})
+
+	if _, err := conn.Subscribe("q", Options{Expires: 1800}); err != errMaxConsumers {
+		t.Errorf("expected %s, got %v", errMaxConsumers, err)
+	}
+	_ = sub.Close()
+
+	sub, err := conn.Subscribe("q", Options{Expires: 1800})
+	if err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	_ = sub.Close()
+}
+
+// Must fail dialing unreachable node
+func TestRedis_Dial(t *testing.T) {
+	if _, err := DialRedis("redis://127.0.0.1:1"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRedis_After(t *testing.T) {
+	samples := []struct {
+		a, b   string
+		expect bool
+	}{
+		{a: "1-0", b: "", expect: true},
+		{a: "1-0", b: "1-0", expect: false},
+		{a: "1-1", b: "1-0", expect: true},
+		{a: "2-0", b: "10-0", expect: false},
+		{a: "10-0", b: "2-5", expect: true},
+	}
+
+	for _, sample := range samples {
+		if result := redisAfter(sample.a, sample.b); result != sample.expect {
+			t.Errorf("%s > %s: expected %t", sample.a, sample.b, sample.expect)
+		}
+	}
+}
+
+// Must redeliver nacked entry, count deliveries, dead-letter rejected one
+func TestRedis_Nack(t *testing.T) {
+	server, conn := testRedis(t)
+
+	sub, _ := conn.Subscribe("q", Options{Expires: 1800})
+	defer func() { _ = sub.Close() }()
+
+	id, _ := server.XAdd("q", "*", []string{"data", "foo"})
+
+	for i := 1; i <= 2; i++ {
+		msg := testReceive(t, sub)
+		if msg.ID() != id || msg.Deliveries() != i {
+			t.Errorf("unexpected message %s delivered %d times", msg.ID(), msg.Deliveries())
+		}
+		_ = msg.Nack(true)
+	}
+
+	if err := testReceive(t, sub).Nack(false); err != nil {
+		t.Error(err)
+	}
+
+	entries, _ := server.Stream("q")
+	if len(entries) != 0 {
+		t.Errorf("expected empty stream, got %d entries", len(entries))
+	}
+	dead, _ := server.Stream(redisDead("q"))
+	if len(dead) != 1 || dead[0].Values[1] != "foo" {
+		t.Errorf("expected dead letter, got %v", dead)
+	}
+}
+
+// Must deliver up to prefetch entries ahead
+func TestRedis_Prefetch(t *testing.T) {
+	server, conn := testRedis(t)
+
+	for _, body := range []string{"foo", "bar", "baz"} {
+		_, _ = server.XAdd("q", "*", []string{"data", body})
+	}
+
+	sub, _ := conn.Subscribe("q", Options{Expires: 1800, Prefetch: 2})
+	defer func() { _ = sub.Close() }()
+
+	foo := testReceive(t, sub)
+	bar := testReceive(t, sub)
+
+	select {
+	case <-sub.Messages():
+		t.Error("unexpected delivery beyond prefetch")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	_ = foo.Ack()
+	_ = bar.Ack()
+
+	if msg := testReceive(t, sub); string(msg.Body()) != "baz" {
+		t.Errorf("expected baz, got %s", msg.Body())
+	}
+}
+
+// Must take the timestamp from the entry id
+func TestRedis_Timestamp(t *testing.T) {
+	server, conn := testRedis(t)
+
+	sub, _ := conn.Subscribe("q", Options{Expires: 1800})
+	defer func() { _ = sub.Close() }()
+
+	_, _ = server.XAdd("q", "1551441600005-0", []string{"data", "foo"})
+
+	expect := time.Date(2019, 3, 1, 12, 0, 0, 5e6, time.UTC)
+	result := testReceive(t, sub).(Timestamper).Timestamp("")
+
+	if !result.Equal(expect) {
+		t.Errorf("expected %s, got %s", expect, result)
+	}
+}
+
+// Must append published messages to the stream named by the exchange
+func TestRedis_Publish(t *testing.T) {
+	server, conn := testRedis(t)
+
+	if err := conn.(Publisher).Publish("presence", "connected", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := server.Stream("presence")
+	if len(entries) != 1 || entries[0].Values[1] != "connected" || entries[0].Values[3] != "{}" {
+		t.Errorf("unexpected entries %v", entries)
+	}
+}
@@ -0,0 +1,105 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// secretRegEx matches the ${file:path}, ${env:NAME} and ${exec:command}
+// references to credentials in the user info of broker nodes.
+var secretRegEx = regexp.MustCompile(`\$\{(file|env|exec):([^}]+)\}`)
+
+// secretTimeout bounds the run of a credential helper.
+const secretTimeout = 10 * time.Second
+
+// ParseNode parses the URL of a broker node, which may reference its
+// credentials as secrets, e.g. amqp://${env:USER}:${file:/run/pw}@host/.
+// References are kept in the URL and resolved on each dial, so rotated
+// credentials apply on reconnect.
+func ParseNode(node string) (*url.URL, error) {
+	return url.Parse(secretRegEx.ReplaceAllStringFunc(node, func(ref string) string {
+		return strings.ReplaceAll(url.QueryEscape(ref), "+", "%20")
+	}))
+}
+
+// Redact masks the password of a broker node for display, unless it is a
+// reference to a secret.
+func Redact(node string) string {
+	u, err := ParseNode(node)
+	if err != nil || u.User == nil {
+		return node
+	}
+	if password, ok := u.User.Password(); !ok || secretRegEx.FindString(password) == password {
+		return node
+	}
+	return u.Redacted()
+}
+
+// resolveSecrets returns the URL with the secrets referenced by its user
+// info resolved. The URL is returned as is without references.
+func resolveSecrets(u *url.URL) (*url.URL, error) {
+	if u.User == nil {
+		return u, nil
+	}
+	var errs []error
+
+	resolve := func(s string) string {
+		return secretRegEx.ReplaceAllStringFunc(s, func(ref string) string {
+			m := secretRegEx.FindStringSubmatch(ref)
+			val, err := secret(m[1], m[2])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("secret %s: %w", m[1], err))
+			}
+			return val
+		})
+	}
+
+	resolved := *u
+	username := resolve(u.User.Username())
+	if password, ok := u.User.Password(); ok {
+		resolved.User = url.UserPassword(username, resolve(password))
+	} else {
+		resolved.User = url.User(username)
+	}
+	return &resolved, errors.Join(errs...)
+}
+
+// secret reads a secret, trailing line breaks removed.
+func secret(kind, key string) (string, error) {
+	var val []byte
+	var err error
+
+	switch kind {
+	case "file":
+		val, err = os.ReadFile(key)
+	case "env":
+		s, ok := os.LookupEnv(key)
+		if !ok {
+			return "", fmt.Errorf("%s not set", key)
+		}
+		val = []byte(s)
+	case "exec":
+		args := strings.Fields(key)
+		if len(args) == 0 {
+			return "", errors.New("no command")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+		defer cancel()
+		val, err = exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	default:
+		err = fmt.Errorf("unknown kind %q", kind)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(val), "\r\n"), nil
+}
@@ -0,0 +1,173 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+type (
+	subscription struct {
+		ch       *amqp.Channel
+		queue    string
+		messages chan Message
+		done     chan struct{}
+		once     sync.Once
+	}
+	message struct {
+		delivery amqp.Delivery
+		// republish appends a message to the queue it was consumed from.
+		republish func(msg amqp.Publishing) error
+	}
+)
+
+// deliveriesHeader counts the deliveries of a message requeued from a
+// classic queue, which tracks no x-delivery-count.
+const deliveriesHeader = "x-eventsourced-deliveries"
+
+func newSubscription(ch *amqp.Channel, queue string, d <-chan amqp.Delivery, prefetch int) Subscription {
+	s := &subscription{
+		ch:       ch,
+		queue:    queue,
+		messages: make(chan Message, prefetch),
+		done:     make(chan struct{}),
+	}
+	go s.forward(d)
+	return s
+}
+
+// Messages ...
+func (s *subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+// Close ...
+func (s *subscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.ch.Close()
+	})
+	return err
+}
+
+func (s *subscription) forward(d <-chan amqp.Delivery) {
+	defer close(s.messages)
+
+	republish := func(msg amqp.Publishing) error {
+		return s.ch.Publish("", s.queue, false, false, msg)
+	}
+	for delivery := range d {
+		select {
+		case s.messages <- &message{delivery: delivery, republish: republish}:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// ID ...
+func (m *message) ID() string {
+	return ""
+}
+
+// Body ...
+func (m *message) Body() []byte {
+	return m.delivery.Body
+}
+
+// Deliveries is taken from the x-delivery-count header of quorum queues,
+// or counted by the header of messages requeued from classic queues.
+func (m *message) Deliveries() int {
+	if count, ok := tableInt(m.delivery.Headers["x-delivery-count"]); ok {
+		return count + 1
+	}
+	if count, ok := tableInt(m.delivery.Headers[deliveriesHeader]); ok {
+		return count + 1
+	}
+	if m.delivery.Redelivered {
+		return 2
+	}
+	return 1
+}
+
+// Timestamp returns the time of the header given, or the timestamp
+// property set by the publisher.
+func (m *message) Timestamp(header string) time.Time {
+	if header != "" {
+		return headerTime(m.delivery.Headers[header])
+	}
+	return m.delivery.Timestamp
+}
+
+// Header returns a string or byte array header value.
+func (m *message) Header(key string) string {
+	switch v := m.delivery.Headers[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// Ack ...
+func (m *message) Ack() error {
+	return m.delivery.Ack(false)
+}
+
+// AckMultiple acknowledges all deliveries up to this delivery tag.
+func (m *message) AckMultiple() error {
+	return m.delivery.Ack(true)
+}
+
+// Nack rejects the delivery, the queue's dead letter exchange receives it
+// when not requeued. Classic queues do not count deliveries, a message of
+// theirs is requeued by publishing a copy counting its deliveries to the
+// end of the queue, then acking it.
+func (m *message) Nack(requeue bool) error {
+	if _, ok := tableInt(m.delivery.Headers["x-delivery-count"]); ok || !requeue || m.republish == nil {
+		return m.delivery.Nack(false, requeue)
+	}
+
+	headers := amqp.Table{}
+	for k, v := range m.delivery.Headers {
+		headers[k] = v
+	}
+	headers[deliveriesHeader] = int32(m.Deliveries())
+
+	err := m.republish(amqp.Publishing{
+		Headers:         headers,
+		ContentType:     m.delivery.ContentType,
+		ContentEncoding: m.delivery.ContentEncoding,
+		DeliveryMode:    m.delivery.DeliveryMode,
+		Priority:        m.delivery.Priority,
+		CorrelationId:   m.delivery.CorrelationId,
+		ReplyTo:         m.delivery.ReplyTo,
+		Expiration:      m.delivery.Expiration,
+		MessageId:       m.delivery.MessageId,
+		Timestamp:       m.delivery.Timestamp,
+		Type:            m.delivery.Type,
+		UserId:          m.delivery.UserId,
+		AppId:           m.delivery.AppId,
+		Body:            m.delivery.Body,
+	})
+	if err != nil {
+		return m.delivery.Nack(false, true)
+	}
+	return m.delivery.Ack(false)
+}
+
+// tableInt returns an integer value of an AMQP table.
+func tableInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int64:
+		return int(n), true
+	case int32:
+		return int(n), true
+	}
+	return 0, false
+}
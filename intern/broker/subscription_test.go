@@ -0,0 +1,74 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+type testAcknowledger struct {
+	acks, nacks, requeues int
+}
+
+func (a *testAcknowledger) Ack(uint64, bool) error { a.acks++; return nil }
+
+func (a *testAcknowledger) Nack(_ uint64, _, requeue bool) error {
+	if a.nacks++; requeue {
+		a.requeues++
+	}
+	return nil
+}
+
+func (a *testAcknowledger) Reject(uint64, bool) error { return nil }
+
+// Must count the deliveries of messages requeued from a classic queue
+// until rejected beyond the redelivery limit
+func TestMessage_Deliveries(t *testing.T) {
+	const redeliver = 2
+	ack := &testAcknowledger{}
+
+	var queue []amqp.Publishing
+	republish := func(msg amqp.Publishing) error {
+		queue = append(queue, msg)
+		return nil
+	}
+
+	msg := &message{
+		delivery:  amqp.Delivery{Acknowledger: ack, Body: []byte("foo")},
+		republish: republish,
+	}
+	for n := 1; ; n++ {
+		if msg.Deliveries() > redeliver {
+			_ = msg.Nack(false)
+			break
+		}
+		_ = msg.Nack(true)
+
+		p := queue[len(queue)-1]
+		if string(p.Body) != "foo" || p.Headers[deliveriesHeader] != int32(msg.Deliveries()) {
+			t.Fatalf("unexpected copy %+v", p)
+		}
+		msg = &message{
+			delivery:  amqp.Delivery{Acknowledger: ack, Body: p.Body, Headers: p.Headers},
+			republish: republish,
+		}
+		if msg.Deliveries() != n+1 {
+			t.Fatalf("expected %d deliveries, got %d", n+1, msg.Deliveries())
+		}
+	}
+	if len(queue) != redeliver || ack.acks != redeliver || ack.nacks != 1 || ack.requeues != 0 {
+		t.Errorf("unexpected outcome %d %+v", len(queue), ack)
+	}
+
+	quorum := &message{
+		delivery:  amqp.Delivery{Acknowledger: ack, Headers: amqp.Table{"x-delivery-count": int64(4)}},
+		republish: republish,
+	}
+	_ = quorum.Nack(true)
+
+	if quorum.Deliveries() != 5 || ack.requeues != 1 || len(queue) != redeliver {
+		t.Errorf("expected quorum queue to count, got %d %+v", quorum.Deliveries(), ack)
+	}
+}
@@ -0,0 +1,35 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package conf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Must reject unknown fields, locating them by file and line
+func TestConfig_Strict(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yml")
+	invalid := filepath.Join(dir, "invalid.yml")
+	_ = os.WriteFile(valid, []byte("queue:\n  expires: 60\nheader:\n  cors:\n    Access-Control-Allow-Origin: example.com\n"), 0600)
+	_ = os.WriteFile(invalid, []byte("queue:\n  pattern: ${query:id}\n  expire: 60\n"), 0600)
+
+	c := NewConfig(filepath.Join(dir, "missing.yml"), valid)
+	if c.Err() != nil || !c.Loaded() || c.Queue.Expires != 60 {
+		t.Errorf("unexpected config %v %+v", c.Err(), c.Queue)
+	}
+	if c.Header.CORS["Access-Control-Allow-Origin"] != "example.com" || c.Header.SSE["Cache-Control"] != "no-cache" {
+		t.Errorf("unexpected header %+v", c.Header)
+	}
+
+	c = NewConfig(invalid)
+	if c.Loaded() || c.Err() == nil {
+		t.Fatal("expected error")
+	}
+	if s := c.Err().Error(); !strings.Contains(s, invalid+":") || !strings.Contains(s, "line 3: field expire not found") {
+		t.Errorf("unexpected error %q", s)
+	}
+}
@@ -0,0 +1,117 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the names of environment variables overriding entries.
+const EnvPrefix = "EVENTSOURCED"
+
+// Override sets the entries given by environment variables, looked up by
+// the prefix and the upper case keys joined by underscores, e.g.
+// EVENTSOURCED_SERVER_ADDRESS. Lists are replaced by comma separated
+// values, or set by index, e.g. EVENTSOURCED_BROKER_NODE_0, where the
+// index next to the last appends. Maps are not overridden. Returns the
+// names of the variables applied, invalid values are skipped.
+func (c *Config) Override(lookup func(string) (string, bool)) ([]string, error) {
+	o := &overrider{lookup: lookup}
+	o.override(reflect.ValueOf(c).Elem(), EnvPrefix)
+
+	return o.applied, errors.Join(o.errs...)
+}
+
+type overrider struct {
+	lookup  func(string) (string, bool)
+	applied []string
+	errs    []error
+}
+
+func (o *overrider) override(v reflect.Value, prefix string) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if !t.Field(i).IsExported() || key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		field := v.Field(i)
+
+		switch field.Kind() {
+		case reflect.Struct:
+			o.override(field, name)
+		case reflect.Map:
+		case reflect.Slice:
+			o.overrideList(field, name)
+		default:
+			if val, ok := o.lookup(name); ok {
+				o.set(field, name, val)
+			}
+		}
+	}
+}
+
+func (o *overrider) overrideList(field reflect.Value, name string) {
+	if val, ok := o.lookup(name); ok {
+		list := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, s := range strings.Split(val, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = reflect.Append(list, reflect.ValueOf(s))
+			}
+		}
+		field.Set(list)
+		o.applied = append(o.applied, name)
+	}
+
+	for i := 0; i <= field.Len(); i++ {
+		indexed := name + "_" + strconv.Itoa(i)
+		val, ok := o.lookup(indexed)
+		if !ok {
+			continue
+		}
+		if i == field.Len() {
+			field.Set(reflect.Append(field, reflect.ValueOf(val)))
+		} else {
+			field.Index(i).SetString(val)
+		}
+		o.applied = append(o.applied, indexed)
+	}
+}
+
+func (o *overrider) set(field reflect.Value, name, val string) {
+	var err error
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(val); err == nil {
+			field.SetBool(b)
+		}
+	case reflect.Int:
+		var n int64
+		if n, err = strconv.ParseInt(val, 10, 0); err == nil {
+			field.SetInt(n)
+		}
+	case reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(val, 64); err == nil {
+			field.SetFloat(f)
+		}
+	default:
+		err = errors.New("unsupported type")
+	}
+
+	if err != nil {
+		o.errs = append(o.errs, fmt.Errorf("config: %s: %w", name, err))
+		return
+	}
+	o.applied = append(o.applied, name)
+}
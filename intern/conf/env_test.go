@@ -0,0 +1,57 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package conf
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Must override entries by environment variables
+func TestConfig_Override(t *testing.T) {
+	env := map[string]string{
+		"EVENTSOURCED_SERVER_ADDRESS":        "127.0.0.1:8080",
+		"EVENTSOURCED_SERVER_WRITE_TIMEOUT":  "20",
+		"EVENTSOURCED_BROKER_NODE_1":         "amqp://b",
+		"EVENTSOURCED_BROKER_NODE_2":         "amqp://c",
+		"EVENTSOURCED_QUEUE_LATENCY_HEADER":  "x-published",
+		"EVENTSOURCED_QUEUE_LATENCY_COMMENT": "true",
+		"EVENTSOURCED_TRACING_SAMPLE":        "0.5",
+		"EVENTSOURCED_SERVER_MAX_IDLE":       "forever",
+		"EVENTSOURCED_HEADER_CORS":           "ignored",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	c := NewConfig()
+	applied, err := c.Override(lookup)
+
+	if err == nil || err.Error() != `config: EVENTSOURCED_SERVER_MAX_IDLE: strconv.ParseInt: parsing "forever": invalid syntax` {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(applied) != 7 {
+		t.Errorf("unexpected variables applied %v", applied)
+	}
+
+	expect := NewConfig()
+	expect.Server.Address = "127.0.0.1:8080"
+	expect.Server.WriteTimeout = 20
+	expect.Broker.Node = []string{expect.Broker.Node[0], "amqp://b", "amqp://c"}
+	expect.Queue.Latency = Latency{Header: "x-published", Comment: true}
+	expect.Tracing.Sample = 0.5
+
+	if !reflect.DeepEqual(c, expect) {
+		t.Errorf("expected %+v, got %+v", expect, c)
+	}
+
+	env = map[string]string{"EVENTSOURCED_BROKER_NODE": "amqp://a, amqp://b", "EVENTSOURCED_BROKER_NODE_0": "amqp://x"}
+	c = NewConfig()
+	if _, err = c.Override(lookup); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Broker.Node, []string{"amqp://x", "amqp://b"}) {
+		t.Errorf("unexpected nodes %v", c.Broker.Node)
+	}
+}
@@ -3,6 +3,7 @@
 package event
 
 import (
+	"strconv"
 	"strings"
 )
 
@@ -33,6 +34,19 @@ func (e *sseEvent) Data() string  { return e.data }
 func (e *sseEvent) Retry() int    { return e.retry }
 
 func (e *sseEvent) String() string {
+	var id, event, retry string
+	if e.id != "" {
+		id = "id: " + e.id + "\n"
+	}
+	if e.event != "" {
+		event = "event: " + e.event + "\n"
+	}
+	if e.retry > 0 {
+		retry = "retry: " + strconv.Itoa(e.retry) + "\n"
+		if e.data == "" {
+			return id + event + retry
+		}
+	}
 	s := strings.Trim(e.data, "\n")
-	return "data: " + strings.Replace(s, "\n", "\ndata: ", -1) + "\n"
+	return id + event + retry + "data: " + strings.Replace(s, "\n", "\ndata: ", -1) + "\n"
 }
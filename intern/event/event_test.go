@@ -4,6 +4,7 @@ package event
 
 import (
 	"testing"
+	"time"
 )
 
 // Must create string representation of SSE event
@@ -47,3 +48,33 @@ func TestServerSentEvent_Retry(t *testing.T) {
 		t.Errorf("expected retry to be 0")
 	}
 }
+
+// Must prepend the event id when set
+func TestServerSentEvent_IdString(t *testing.T) {
+	expect := "id: 1-0\ndata: x\n"
+	result := NewProducer().IdentifiedEvent("1-0", []byte("x")).String()
+
+	if result != expect {
+		t.Errorf("expected %s, got %s", expect, result)
+	}
+}
+
+// Must emit the retry field only for retry events
+func TestServerSentEvent_RetryString(t *testing.T) {
+	expect := "retry: 1500\n"
+	result := NewProducer().RetryEvent(time.Millisecond * 1500)
+
+	if result.String() != expect || result.Retry() != 1500 {
+		t.Errorf("expected %s, got %s", expect, result.String())
+	}
+}
+
+// Must emit the event type for named events
+func TestServerSentEvent_NamedString(t *testing.T) {
+	expect := "event: closed\ndata: bye\n"
+	result := NewProducer().NamedEvent("closed\n", []byte("bye"))
+
+	if result.String() != expect || result.Event() != "closed" {
+		t.Errorf("expected %s, got %s", expect, result.String())
+	}
+}
@@ -4,17 +4,24 @@ package event
 
 import (
 	"strings"
+	"time"
 )
 
 type (
 	// Producer ...
 	Producer interface {
 		ServerSentEvent([]byte) ServerSentEvent
+		IdentifiedEvent(string, []byte) ServerSentEvent
+		RetryEvent(time.Duration) ServerSentEvent
+		NamedEvent(string, []byte) ServerSentEvent
 	}
 	producer struct{}
 )
 
-var cleaner = strings.NewReplacer("\r\n", "\n", "\r", "")
+var (
+	cleaner  = strings.NewReplacer("\r\n", "\n", "\r", "")
+	idFilter = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+)
 
 // NewProducer ...
 func NewProducer() Producer {
@@ -22,10 +29,33 @@ func NewProducer() Producer {
 }
 
 func (f *producer) ServerSentEvent(data []byte) ServerSentEvent {
+	return f.IdentifiedEvent("", data)
+}
+
+// IdentifiedEvent creates an event with an id, which the client sends
+// back in the Last-Event-ID header when reconnecting.
+func (f *producer) IdentifiedEvent(id string, data []byte) ServerSentEvent {
 	return newServerSentEvent(
+		idFilter.Replace(id),
 		"",
+		strings.Trim(cleaner.Replace(string(data)), " \n")+"\n",
+		0,
+	)
+}
+
+// NamedEvent creates an event of the given type, which clients listen to
+// with addEventListener instead of onmessage.
+func (f *producer) NamedEvent(kind string, data []byte) ServerSentEvent {
+	return newServerSentEvent(
 		"",
+		idFilter.Replace(kind),
 		strings.Trim(cleaner.Replace(string(data)), " \n")+"\n",
 		0,
 	)
 }
+
+// RetryEvent creates an event without data, which sets the reconnection
+// delay of the client.
+func (f *producer) RetryEvent(retry time.Duration) ServerSentEvent {
+	return newServerSentEvent("", "", "", int(retry/time.Millisecond))
+}
@@ -28,3 +28,24 @@ func TestProducer_Event(t *testing.T) {
 		})
 	}
 }
+
+// Must strip line breaks from event id
+func TestProducer_IdentifiedEvent(t *testing.T) {
+	samples := []struct{ given, expect string }{
+		{given: "" /*   */, expect: ""},
+		{given: "1-0" /**/, expect: "1-0"},
+		{given: "1\r\n-0\x00", expect: "1-0"},
+	}
+
+	p := NewProducer()
+
+	for _, sample := range samples {
+		t.Run("", func(t *testing.T) {
+			result := p.IdentifiedEvent(sample.given, nil)
+
+			if result.ID() != sample.expect {
+				t.Errorf("expected %s, got %s", sample.expect, result.ID())
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+
+	"eventsourced/intern/conf"
+)
+
+// Formats of the log lines.
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// NewLogger creates a leveled logger writing key=value pairs (logfmt) or
+// JSON objects, one line per record.
+func NewLogger(w io.Writer, config conf.Log) (*slog.Logger, error) {
+	var level slog.Level
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return nil, fmt.Errorf("log: %w", err)
+		}
+	}
+	options := &slog.HandlerOptions{Level: level}
+
+	switch config.Format {
+	case "", FormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("log: unknown format %q", config.Format)
+	}
+}
+
+// Discard returns a logger dropping all records.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{
+		Level: slog.Level(math.MaxInt32),
+	}))
+}
@@ -0,0 +1,49 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"eventsourced/intern/conf"
+)
+
+// Must write leveled records in the configured format
+func TestNewLogger(t *testing.T) {
+	samples := []struct {
+		config conf.Log
+		lines  int
+		expect string
+	}{
+		{config: conf.Log{}, lines: 1, expect: `level=INFO msg="server: listening" address=:2069` + "\n"},
+		{config: conf.Log{Level: "info", Format: "logfmt"}, lines: 1, expect: `level=INFO msg="server: listening" address=:2069` + "\n"},
+		{config: conf.Log{Level: "debug", Format: "json"}, lines: 2, expect: `"level":"INFO","msg":"server: listening","address":":2069"}` + "\n"},
+		{config: conf.Log{Level: "warn"}, lines: 0, expect: ""},
+	}
+
+	for _, sample := range samples {
+		buf := &bytes.Buffer{}
+		logger, err := NewLogger(buf, sample.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Debug("server: debug")
+		logger.Info("server: listening", "address", ":2069")
+
+		result := buf.String()
+		if strings.Count(result, "\n") != sample.lines || !strings.HasSuffix(result, sample.expect) {
+			t.Errorf("%+v: unexpected records %q", sample.config, result)
+		}
+	}
+}
+
+// Must reject unknown levels and formats
+func TestNewLogger_Error(t *testing.T) {
+	for _, config := range []conf.Log{{Level: "verbose"}, {Format: "xml"}} {
+		if _, err := NewLogger(&bytes.Buffer{}, config); err == nil {
+			t.Errorf("%+v: expected error", config)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package metric
 
 import (
 	"expvar"
+	"io"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -16,13 +17,27 @@ type (
 		Publish() Metric
 		Report() interface{}
 
-		IncBrokerCount()
-		DecBrokerCount()
+		IncBrokerCount(node string)
+		DecBrokerCount(node string)
 
-		IncConsumerCount()
-		DecConsumerCount()
+		IncConsumerCount(Labels)
+		DecConsumerCount(Labels)
 
-		IncDeliveryCount()
+		IncDeliveryCount(Labels)
+		IncRequeueCount()
+		IncDeadLetterCount()
+		IncAbortCount()
+		IncEvictCount()
+		IncShedCount()
+
+		IncAckCount()
+		IncRequestCount(status int)
+		ObserveStreamDuration(time.Duration)
+		ObserveDeliveryLatency(time.Duration)
+		ObserveFlushTime(time.Duration)
+		ObservePublishLatency(group string, d time.Duration)
+
+		WritePrometheus(w io.Writer) error
 	}
 	metric struct {
 		sync.Mutex
@@ -33,6 +48,29 @@ type (
 
 		deliveryCount  int64
 		deliverySample int64
+
+		requeue    int64
+		deadLetter int64
+		abort      int64
+		evict      int64
+		shed       int64
+
+		acks     int64
+		requests map[int]int64
+		nodes    map[string]int64
+		labeled  map[Labels]*Breakdown
+
+		streamDuration  *histogram
+		deliveryLatency *histogram
+		flushTime       *histogram
+		publishLatency  map[string]*histogram
+	}
+
+	// Labels break down the stream metrics by the sanitized URL of the
+	// broker node and by the group of the queue name.
+	Labels struct {
+		Node  string
+		Group string
 	}
 
 	// Stats ...
@@ -40,14 +78,39 @@ type (
 		Broker     int64
 		Consumer   int64
 		Delivery   int64
+		Requeue    int64
+		DeadLetter int64
+		Abort      int64
+		Evict      int64
+		Shed       int64
 		Goroutines int
 		Uptime     time.Duration
+		Node       map[string]Breakdown
+		Group      map[string]Breakdown
+	}
+
+	// Breakdown holds the open connections and streams and the total
+	// deliveries of a broker node or queue group.
+	Breakdown struct {
+		Broker   int64 `json:",omitempty"`
+		Consumer int64
+		Delivery int64
 	}
 )
 
 // NewMetric ...
 func NewMetric(namespace string) Metric {
-	return &metric{namespace: namespace, startTime: time.Now().UTC()}
+	return &metric{
+		namespace:       namespace,
+		startTime:       time.Now().UTC(),
+		requests:        map[int]int64{},
+		nodes:           map[string]int64{},
+		labeled:         map[Labels]*Breakdown{},
+		streamDuration:  newHistogram(durationBuckets),
+		deliveryLatency: newHistogram(latencyBuckets),
+		flushTime:       newHistogram(latencyBuckets),
+		publishLatency:  map[string]*histogram{},
+	}
 }
 
 func (m *metric) Publish() Metric {
@@ -69,20 +132,105 @@ func (m *metric) Publish() Metric {
 func (m *metric) Report() interface{} {
 	m.Lock()
 	defer m.Unlock()
+
+	nodes := map[string]Breakdown{}
+	groups := map[string]Breakdown{}
+
+	for node, count := range m.nodes {
+		nodes[node] = Breakdown{Broker: count}
+	}
+	for labels, b := range m.labeled {
+		n, g := nodes[labels.Node], groups[labels.Group]
+		n.Consumer, n.Delivery = n.Consumer+b.Consumer, n.Delivery+b.Delivery
+		g.Consumer, g.Delivery = g.Consumer+b.Consumer, g.Delivery+b.Delivery
+		nodes[labels.Node], groups[labels.Group] = n, g
+	}
+
 	return Stats{
-		Broker:     m.broker,
-		Consumer:   m.consumer,
+		Broker:     atomic.LoadInt64(&m.broker),
+		Consumer:   atomic.LoadInt64(&m.consumer),
 		Delivery:   m.deliverySample,
+		Requeue:    atomic.LoadInt64(&m.requeue),
+		DeadLetter: atomic.LoadInt64(&m.deadLetter),
+		Abort:      atomic.LoadInt64(&m.abort),
+		Evict:      atomic.LoadInt64(&m.evict),
+		Shed:       atomic.LoadInt64(&m.shed),
 		Goroutines: runtime.NumGoroutine(),
 		Uptime:     time.Since(m.startTime),
+		Node:       nodes,
+		Group:      groups,
 	}
 }
 
-func (m *metric) IncBrokerCount() { atomic.AddInt64(&m.broker, 1) }
-func (m *metric) DecBrokerCount() { atomic.AddInt64(&m.broker, -1) }
+func (m *metric) IncBrokerCount(node string) { m.addBrokerCount(node, 1) }
+func (m *metric) DecBrokerCount(node string) { m.addBrokerCount(node, -1) }
+
+func (m *metric) IncConsumerCount(l Labels) { m.addConsumerCount(l, 1) }
+func (m *metric) DecConsumerCount(l Labels) { m.addConsumerCount(l, -1) }
 
-func (m *metric) IncConsumerCount() { atomic.AddInt64(&m.consumer, 1) }
-func (m *metric) DecConsumerCount() { atomic.AddInt64(&m.consumer, -1) }
+func (m *metric) IncDeliveryCount(l Labels) {
+	atomic.AddInt64(&m.deliveryCount, 1)
 
-func (m *metric) IncDeliveryCount() { atomic.AddInt64(&m.deliveryCount, 1) }
+	m.Lock()
+	defer m.Unlock()
+	m.breakdown(l).Delivery++
+}
 func (m *metric) rstDeliveryCount() { atomic.StoreInt64(&m.deliveryCount, 0) }
+
+func (m *metric) IncRequeueCount()    { atomic.AddInt64(&m.requeue, 1) }
+func (m *metric) IncDeadLetterCount() { atomic.AddInt64(&m.deadLetter, 1) }
+func (m *metric) IncAbortCount()      { atomic.AddInt64(&m.abort, 1) }
+
+func (m *metric) IncEvictCount() { atomic.AddInt64(&m.evict, 1) }
+func (m *metric) IncShedCount()  { atomic.AddInt64(&m.shed, 1) }
+func (m *metric) IncAckCount()   { atomic.AddInt64(&m.acks, 1) }
+
+func (m *metric) IncRequestCount(status int) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests[status]++
+}
+
+func (m *metric) ObserveStreamDuration(d time.Duration)  { m.streamDuration.observe(d) }
+func (m *metric) ObserveDeliveryLatency(d time.Duration) { m.deliveryLatency.observe(d) }
+func (m *metric) ObserveFlushTime(d time.Duration)       { m.flushTime.observe(d) }
+
+func (m *metric) ObservePublishLatency(group string, d time.Duration) {
+	m.Lock()
+	h, ok := m.publishLatency[group]
+	if !ok {
+		h = newHistogram(publishBuckets)
+		m.publishLatency[group] = h
+	}
+	m.Unlock()
+
+	h.observe(d)
+}
+
+func (m *metric) addBrokerCount(node string, n int64) {
+	atomic.AddInt64(&m.broker, n)
+
+	m.Lock()
+	defer m.Unlock()
+	m.nodes[node] += n
+}
+
+func (m *metric) addConsumerCount(l Labels, n int64) {
+	atomic.AddInt64(&m.consumer, n)
+
+	m.Lock()
+	defer m.Unlock()
+	m.breakdown(l).Consumer += n
+}
+
+// breakdown must be called with the lock held.
+func (m *metric) breakdown(l Labels) *Breakdown {
+	b, ok := m.labeled[l]
+	if !ok {
+		b = &Breakdown{}
+		m.labeled[l] = b
+	}
+	return b
+}
+
+func (m *metric) load(v *int64) float64 { return float64(atomic.LoadInt64(v)) }
@@ -11,9 +11,9 @@ import (
 func TestMetric_Publish(t *testing.T) {
 	m := NewMetric("")
 
-	m.IncDeliveryCount()
-	m.IncDeliveryCount()
-	m.IncDeliveryCount()
+	m.IncDeliveryCount(Labels{})
+	m.IncDeliveryCount(Labels{})
+	m.IncDeliveryCount(Labels{})
 	m.Publish()
 
 	expect := int64(0)
@@ -41,11 +41,11 @@ func TestMetric_BrokerCount(t *testing.T) {
 	wg := &sync.WaitGroup{}
 	for i := 0; i < 42; i++ {
 		wg.Add(1)
-		go func() { m.IncBrokerCount(); wg.Done() }()
+		go func() { m.IncBrokerCount("node"); wg.Done() }()
 
 		if i%10 == 0 {
 			wg.Add(1)
-			go func() { m.DecBrokerCount(); wg.Done() }()
+			go func() { m.DecBrokerCount("node"); wg.Done() }()
 		}
 	}
 	wg.Wait()
@@ -65,11 +65,11 @@ func TestMetric_ConsumerCount(t *testing.T) {
 	wg := &sync.WaitGroup{}
 	for i := 0; i < 42; i++ {
 		wg.Add(1)
-		go func() { m.IncConsumerCount(); wg.Done() }()
+		go func() { m.IncConsumerCount(Labels{}); wg.Done() }()
 
 		if i%10 == 0 {
 			wg.Add(1)
-			go func() { m.DecConsumerCount(); wg.Done() }()
+			go func() { m.DecConsumerCount(Labels{}); wg.Done() }()
 		}
 	}
 	wg.Wait()
@@ -81,3 +81,67 @@ func TestMetric_ConsumerCount(t *testing.T) {
 		t.Errorf("expected %d, got %d", expect, result)
 	}
 }
+
+// Must break down streams and deliveries by broker node and queue group
+func TestMetric_Breakdown(t *testing.T) {
+	m := NewMetric("")
+
+	a := Labels{Node: "n0:5672", Group: "a"}
+	b := Labels{Node: "n1:5672", Group: "a"}
+	c := Labels{Node: "n1:5672", Group: "c"}
+
+	m.IncBrokerCount("n0:5672")
+	m.IncBrokerCount("n1:5672")
+	m.IncBrokerCount("n1:5672")
+	m.IncConsumerCount(a)
+	m.IncConsumerCount(b)
+	m.IncConsumerCount(c)
+	m.DecConsumerCount(c)
+	m.IncDeliveryCount(a)
+	m.IncDeliveryCount(b)
+	m.IncDeliveryCount(c)
+
+	stats := m.Report().(Stats)
+
+	if stats.Broker != 3 || stats.Consumer != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if n := stats.Node["n1:5672"]; n != (Breakdown{Broker: 2, Consumer: 1, Delivery: 2}) {
+		t.Errorf("unexpected node breakdown %+v", n)
+	}
+	if g := stats.Group["a"]; g != (Breakdown{Consumer: 2, Delivery: 2}) {
+		t.Errorf("unexpected group breakdown %+v", g)
+	}
+	if g := stats.Group["c"]; g != (Breakdown{Consumer: 0, Delivery: 1}) {
+		t.Errorf("unexpected group breakdown %+v", g)
+	}
+}
+
+// Must count outcomes of failed deliveries, must not cause a data race
+func TestMetric_FailureCount(t *testing.T) {
+	m := NewMetric("")
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 42; i++ {
+		wg.Add(2)
+		go func() { m.IncAbortCount(); wg.Done() }()
+		go func() { m.IncRequeueCount(); wg.Done() }()
+
+		wg.Add(2)
+		go func() { m.IncEvictCount(); wg.Done() }()
+		go func() { m.IncShedCount(); wg.Done() }()
+
+		if i%2 == 0 {
+			wg.Add(1)
+			go func() { m.IncDeadLetterCount(); wg.Done() }()
+		}
+	}
+	wg.Wait()
+
+	stats := m.Report().(Stats)
+
+	if stats.Abort != 42 || stats.Requeue != 42 || stats.DeadLetter != 21 ||
+		stats.Evict != 42 || stats.Shed != 42 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
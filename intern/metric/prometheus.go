@@ -0,0 +1,208 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package metric
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	histogram struct {
+		mu      sync.Mutex
+		bounds  []float64
+		buckets []uint64
+		sum     float64
+		count   uint64
+	}
+
+	// exposition writes the Prometheus text format, keeping the first error.
+	exposition struct {
+		w         io.Writer
+		namespace string
+		err       error
+	}
+)
+
+var (
+	durationBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 14400}
+	latencyBuckets  = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	publishBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 1800}
+)
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *metric) WritePrometheus(w io.Writer) error {
+	e := &exposition{w: w, namespace: promName(m.namespace)}
+
+	m.Lock()
+	labeled := make([]Labels, 0, len(m.labeled))
+	for l := range m.labeled {
+		labeled = append(labeled, l)
+	}
+	sort.Slice(labeled, func(i, j int) bool {
+		a, b := labeled[i], labeled[j]
+		return a.Node < b.Node || a.Node == b.Node && a.Group < b.Group
+	})
+	deliveries := make([]float64, len(labeled))
+	streams := make([]float64, len(labeled))
+	for i, l := range labeled {
+		deliveries[i] = float64(m.labeled[l].Delivery)
+		streams[i] = float64(m.labeled[l].Consumer)
+	}
+	nodes := make([]string, 0, len(m.nodes))
+	for node := range m.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	connections := make([]float64, len(nodes))
+	for i, node := range nodes {
+		connections[i] = float64(m.nodes[node])
+	}
+	m.Unlock()
+
+	e.family("deliveries_total", "counter", "Messages delivered to clients.")
+	for i, l := range labeled {
+		e.sample("deliveries_total", promLabels(l), deliveries[i])
+	}
+
+	e.family("acks_total", "counter", "Messages acknowledged to the broker.")
+	e.sample("acks_total", "", m.load(&m.acks))
+
+	e.family("nacks_total", "counter", "Messages handed back to the broker.")
+	e.sample("nacks_total", `requeue="true"`, m.load(&m.requeue))
+	e.sample("nacks_total", `requeue="false"`, m.load(&m.deadLetter)+m.load(&m.shed))
+
+	e.family("aborts_total", "counter", "Deliveries aborted by broken client connections.")
+	e.sample("aborts_total", "", m.load(&m.abort))
+
+	e.family("evictions_total", "counter", "Slow clients disconnected.")
+	e.sample("evictions_total", "", m.load(&m.evict))
+
+	e.family("requests_total", "counter", "Stream requests by response status.")
+	m.Lock()
+	statuses := make([]int, 0, len(m.requests))
+	for status := range m.requests {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		e.sample("requests_total", `status="`+strconv.Itoa(status)+`"`, float64(m.requests[status]))
+	}
+	m.Unlock()
+
+	e.family("streams", "gauge", "Open streams.")
+	for i, l := range labeled {
+		e.sample("streams", promLabels(l), streams[i])
+	}
+
+	e.family("broker_connections", "gauge", "Open broker connections.")
+	for i, node := range nodes {
+		e.sample("broker_connections", `node="`+promValue(node)+`"`, connections[i])
+	}
+
+	e.histogram("stream_duration_seconds", "Lifetime of streams.", m.streamDuration)
+	e.histogram("delivery_latency_seconds", "Time from receipt of a message to its acknowledgement.", m.deliveryLatency)
+	e.histogram("flush_seconds", "Time spent writing and flushing to clients.", m.flushTime)
+
+	m.Lock()
+	groups := make([]string, 0, len(m.publishLatency))
+	for group := range m.publishLatency {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	published := make([]*histogram, len(groups))
+	for i, group := range groups {
+		published[i] = m.publishLatency[group]
+	}
+	m.Unlock()
+
+	e.family("publish_latency_seconds", "histogram", "Time from publishing a message to its flush to the client.")
+	for i, group := range groups {
+		e.buckets("publish_latency_seconds", `group="`+promValue(group)+`",`, published[i])
+	}
+
+	return e.err
+}
+
+func (e *exposition) family(name, kind, help string) {
+	e.printf("# HELP %s_%s %s\n", e.namespace, name, help)
+	e.printf("# TYPE %s_%s %s\n", e.namespace, name, kind)
+}
+
+func (e *exposition) sample(name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	e.printf("%s_%s%s %s\n", e.namespace, name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (e *exposition) histogram(name, help string, h *histogram) {
+	e.family(name, "histogram", help)
+	e.buckets(name, "", h)
+}
+
+// buckets writes the samples of a histogram, labels must end with a comma.
+func (e *exposition) buckets(name, labels string, h *histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		le := `le="` + strconv.FormatFloat(bound, 'g', -1, 64) + `"`
+		e.sample(name+"_bucket", labels+le, float64(h.buckets[i]))
+	}
+	e.sample(name+"_bucket", labels+`le="+Inf"`, float64(h.count))
+	e.sample(name+"_sum", strings.TrimSuffix(labels, ","), h.sum)
+	e.sample(name+"_count", strings.TrimSuffix(labels, ","), float64(h.count))
+}
+
+func (e *exposition) printf(format string, a ...interface{}) {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, a...)
+	}
+}
+
+func promLabels(l Labels) string {
+	return `node="` + promValue(l.Node) + `",group="` + promValue(l.Group) + `"`
+}
+
+// promValue escapes a label value.
+func promValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// promName turns the namespace into a valid metric name prefix.
+func promName(namespace string) string {
+	if namespace == "" {
+		return "eventsourced"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, namespace)
+}
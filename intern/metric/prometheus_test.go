@@ -0,0 +1,86 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package metric
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Must expose counters, gauges and histograms of this instance only
+func TestMetric_WritePrometheus(t *testing.T) {
+	m := NewMetric("test")
+
+	m.IncDeliveryCount(Labels{Node: "n1:5672", Group: "a"})
+	m.IncDeliveryCount(Labels{Node: "n1:5672", Group: "a"})
+	m.IncDeliveryCount(Labels{Node: "n0:5672", Group: "b"})
+	m.IncAckCount()
+	m.IncRequeueCount()
+	m.IncShedCount()
+	m.IncDeadLetterCount()
+	m.IncRequestCount(503)
+	m.IncRequestCount(200)
+	m.IncRequestCount(200)
+	m.IncConsumerCount(Labels{Node: "n1:5672", Group: "a"})
+	m.IncBrokerCount("n1:5672")
+	m.IncBrokerCount("n0:5672")
+	m.DecBrokerCount("n0:5672")
+	m.ObserveStreamDuration(time.Second * 30)
+	m.ObserveFlushTime(time.Millisecond * 2)
+	m.ObserveFlushTime(time.Second * 20)
+
+	buf := &bytes.Buffer{}
+	if err := m.WritePrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	result := buf.String()
+
+	for _, expect := range []string{
+		"# TYPE test_deliveries_total counter\n" +
+			"test_deliveries_total{node=\"n0:5672\",group=\"b\"} 1\n" +
+			"test_deliveries_total{node=\"n1:5672\",group=\"a\"} 2\n",
+		"test_acks_total 1\n",
+		"test_nacks_total{requeue=\"true\"} 1\ntest_nacks_total{requeue=\"false\"} 2\n",
+		"test_requests_total{status=\"200\"} 2\ntest_requests_total{status=\"503\"} 1\n",
+		"test_streams{node=\"n0:5672\",group=\"b\"} 0\ntest_streams{node=\"n1:5672\",group=\"a\"} 1\n",
+		"test_broker_connections{node=\"n0:5672\"} 0\ntest_broker_connections{node=\"n1:5672\"} 1\n",
+		"test_stream_duration_seconds_bucket{le=\"10\"} 0\ntest_stream_duration_seconds_bucket{le=\"60\"} 1\n",
+		"test_flush_seconds_bucket{le=\"0.005\"} 1\n",
+		"test_flush_seconds_bucket{le=\"+Inf\"} 2\ntest_flush_seconds_sum 20.002\ntest_flush_seconds_count 2\n",
+		"test_delivery_latency_seconds_count 0\n",
+	} {
+		if !strings.Contains(result, expect) {
+			t.Errorf("expected %q in\n%s", expect, result)
+		}
+	}
+
+	buf.Reset()
+	_ = NewMetric("test").WritePrometheus(buf)
+
+	if strings.Contains(buf.String(), "test_deliveries_total{") {
+		t.Error("expected independent instances")
+	}
+}
+
+// Must escape label values
+func TestMetric_PromValue(t *testing.T) {
+	expect := `a\\b\"c\nd`
+	if result := promValue("a\\b\"c\nd"); result != expect {
+		t.Errorf("expected %s, got %s", expect, result)
+	}
+}
+
+// Must derive a valid metric name prefix
+func TestMetric_PromName(t *testing.T) {
+	samples := []struct{ given, expect string }{
+		{given: "", expect: "eventsourced"},
+		{given: "event-sourced.1", expect: "event_sourced_1"},
+	}
+	for _, sample := range samples {
+		if result := promName(sample.given); result != sample.expect {
+			t.Errorf("expected %s, got %s", sample.expect, result)
+		}
+	}
+}
@@ -5,8 +5,8 @@
 package mock_serv
 
 import (
+	broker "eventsourced/intern/broker"
 	gomock "github.com/golang/mock/gomock"
-	amqp "github.com/streadway/amqp"
 	reflect "reflect"
 )
 
@@ -46,16 +46,16 @@ func (mr *MockConsumerMockRecorder) Close() *gomock.Call {
 }
 
 // Consume mocks base method
-func (m *MockConsumer) Consume(arg0 string) (<-chan amqp.Delivery, error) {
-	ret := m.ctrl.Call(m, "Consume", arg0)
-	ret0, _ := ret[0].(<-chan amqp.Delivery)
+func (m *MockConsumer) Consume(arg0, arg1 string) (<-chan broker.Message, error) {
+	ret := m.ctrl.Call(m, "Consume", arg0, arg1)
+	ret0, _ := ret[0].(<-chan broker.Message)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Consume indicates an expected call of Consume
-func (mr *MockConsumerMockRecorder) Consume(arg0 interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Consume", reflect.TypeOf((*MockConsumer)(nil).Consume), arg0)
+func (mr *MockConsumerMockRecorder) Consume(arg0, arg1 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Consume", reflect.TypeOf((*MockConsumer)(nil).Consume), arg0, arg1)
 }
 
 // Ignore mocks base method
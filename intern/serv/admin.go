@@ -0,0 +1,243 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"eventsourced/intern/broker"
+	"eventsourced/intern/event"
+)
+
+type (
+	authHandler struct {
+		handler
+		token string
+		next  ResponseHandler
+	}
+
+	streamsHandler struct {
+		handler
+		registry Registry
+		producer event.Producer
+	}
+
+	queuesHandler struct {
+		handler
+		brConn  <-chan broker.Connection
+		expires int
+	}
+)
+
+// adminConnectTimeout bounds the wait for a broker connection.
+const adminConnectTimeout = 5 * time.Second
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errNoStream     = errors.New("unknown stream")
+	errNoQueue      = errors.New("queue parameter missing")
+	errNoPath       = errors.New("unknown path")
+	errNoConnection = errors.New("no broker connection")
+	errUnsupported  = errors.New("queue management not supported by broker")
+)
+
+// NewAuthHandler passes requests bearing the token on to next, others are
+// answered with 401. No request passes with an empty token.
+func NewAuthHandler(token string, next ResponseHandler) ResponseHandler {
+	return &authHandler{handler: handler{header: &ResponseHeader{}}, token: token, next: next}
+}
+
+// Handle ...
+func (h *authHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	given, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if !bearer || h.token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="eventsourced"`)
+		h.sendStatus(w, http.StatusUnauthorized, errUnauthorized)
+		return
+	}
+	h.next.Handle(w, r)
+}
+
+// NewStreamsHandler serves the open streams of the registry:
+//
+//	GET    /admin/streams[?queue=name]  lists the streams, of a queue only
+//	DELETE /admin/streams?queue=name    closes the streams of a queue
+//	GET    /admin/streams/{id}          describes a stream
+//	DELETE /admin/streams/{id}          closes a stream
+//
+// Closing requests may carry the event and data parameters of a final
+// event sent to the client.
+func NewStreamsHandler(registry Registry) ResponseHandler {
+	return &streamsHandler{
+		handler:  handler{header: &ResponseHeader{}},
+		registry: registry,
+		producer: event.NewProducer(),
+	}
+}
+
+// Handle ...
+func (h *streamsHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/streams"), "/")
+	queue := r.URL.Query().Get("queue")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		streams := h.registry.Streams()
+		if queue != "" {
+			filtered := streams[:0]
+			for _, s := range streams {
+				if s.Queue == queue {
+					filtered = append(filtered, s)
+				}
+			}
+			streams = filtered
+		}
+		h.sendJSON(w, http.StatusOK, streams)
+
+	case r.Method == "GET":
+		if s, ok := h.registry.Stream(id); ok {
+			h.sendJSON(w, http.StatusOK, s)
+			return
+		}
+		h.sendStatus(w, http.StatusNotFound, errNoStream)
+
+	case r.Method == "DELETE" && id == "":
+		if queue == "" {
+			h.sendStatus(w, http.StatusBadRequest, errNoQueue)
+			return
+		}
+		closed := h.registry.CloseQueue(queue, h.final(r))
+		h.sendJSON(w, http.StatusOK, map[string]int{"closed": closed})
+
+	case r.Method == "DELETE":
+		if h.registry.Close(id, h.final(r)) {
+			h.sendStatus(w, http.StatusNoContent, nil)
+			return
+		}
+		h.sendStatus(w, http.StatusNotFound, errNoStream)
+
+	default:
+		h.sendStatus(w, http.StatusMethodNotAllowed, nil)
+	}
+}
+
+// final creates the event sent before closing, nil without event and data
+// parameters.
+func (h *streamsHandler) final(r *http.Request) event.ServerSentEvent {
+	kind, data := r.URL.Query().Get("event"), r.URL.Query().Get("data")
+	if kind == "" && data == "" {
+		return nil
+	}
+	return h.producer.NamedEvent(kind, []byte(data))
+}
+
+// NewQueuesHandler manages queues through the broker connections, with
+// the expiry of stream queues:
+//
+//	PUT    /admin/queues/{name}           declares a queue
+//	GET    /admin/queues/{name}           tells its messages and consumers
+//	DELETE /admin/queues/{name}           deletes a queue
+//	DELETE /admin/queues/{name}/messages  purges a queue
+//
+// Names are subject to the rules of stream queues, slashes within must
+// be escaped.
+func NewQueuesHandler(brConn <-chan broker.Connection, expires int) ResponseHandler {
+	return &queuesHandler{
+		handler: handler{header: &ResponseHeader{}},
+		brConn:  brConn,
+		expires: expires,
+	}
+}
+
+// Handle ...
+func (h *queuesHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	name, purge, err := queuePath(r.URL)
+	if err != nil {
+		h.sendStatus(w, http.StatusNotFound, err)
+		return
+	}
+	if purge && r.Method != "DELETE" || r.Method != "PUT" && r.Method != "GET" && r.Method != "DELETE" {
+		h.sendStatus(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if err = validQueue(name); err != nil {
+		h.sendStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	conn, err := h.connection(r)
+	if err != nil {
+		h.sendStatus(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	queues, ok := broker.Queues(conn)
+	if !ok {
+		h.sendStatus(w, http.StatusNotImplemented, errUnsupported)
+		return
+	}
+
+	info := broker.QueueInfo{Name: name}
+	switch {
+	case purge:
+		info.Messages, err = queues.PurgeQueue(name)
+	case r.Method == "PUT":
+		info, err = queues.DeclareQueue(name, broker.Options{Expires: h.expires})
+	case r.Method == "GET":
+		info, err = queues.InspectQueue(name)
+	default:
+		info.Messages, err = queues.DeleteQueue(name)
+	}
+
+	switch {
+	case err == broker.ErrNoQueue:
+		h.sendStatus(w, http.StatusNotFound, err)
+	case err != nil:
+		h.sendStatus(w, http.StatusServiceUnavailable, err)
+	default:
+		h.sendJSON(w, http.StatusOK, info)
+	}
+}
+
+// connection waits for a broker connection, until the request is gone
+// or the timeout elapsed.
+func (h *queuesHandler) connection(r *http.Request) (broker.Connection, error) {
+	timeout := time.NewTimer(adminConnectTimeout)
+	defer timeout.Stop()
+
+	select {
+	case conn := <-h.brConn:
+		return conn, nil
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	case <-timeout.C:
+		return nil, errNoConnection
+	}
+}
+
+// queuePath takes the unescaped queue name from the path, purge tells the
+// messages of the queue are addressed.
+func queuePath(u *url.URL) (name string, purge bool, err error) {
+	parts := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/admin/queues/"), "/")
+
+	switch {
+	case len(parts) == 2 && parts[1] == "messages":
+		purge = true
+	case len(parts) != 1:
+		return "", false, errNoPath
+	}
+	name, err = url.PathUnescape(parts[0])
+	return name, purge, err
+}
+
+func (h *handler) sendJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	h.sendStatus(w, status, nil)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,171 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"eventsourced/intern/broker"
+)
+
+type okHandler struct{}
+
+func (okHandler) Handle(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+// Must pass requests bearing the token only
+func TestAuthHandler_Handle(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer func() { log.SetOutput(os.Stderr) }()
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	samples := []struct {
+		token  string
+		header string
+		expect int
+	}{
+		{token: "secret", header: "Bearer secret", expect: 200},
+		{token: "secret", header: "Bearer wrong", expect: 401},
+		{token: "secret", header: "", expect: 401},
+		{token: "", header: "Bearer ", expect: 401},
+		{token: "secret", header: "secret", expect: 401},
+		{token: "secret", header: "Basic secret", expect: 401},
+	}
+
+	for _, sample := range samples {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/admin/streams", nil)
+		request.Header.Set("Authorization", sample.header)
+
+		NewAuthHandler(sample.token, okHandler{}).Handle(recorder, request)
+
+		if recorder.Code != sample.expect {
+			t.Errorf("%q: expected %d, got %d", sample.header, sample.expect, recorder.Code)
+		}
+	}
+}
+
+// Must list, describe and close streams
+func TestStreamsHandler_Handle(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	registry := NewRegistry()
+	a := registry.Register(StreamInfo{Queue: "a"})
+	b := registry.Register(StreamInfo{Queue: "b"})
+	h := NewStreamsHandler(registry)
+
+	handle := func(method, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		h.Handle(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+
+	var streams []StreamInfo
+	if err := json.Unmarshal(handle("GET", "/admin/streams?queue=b").Body.Bytes(), &streams); err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].ID != b.ID() {
+		t.Errorf("unexpected streams %v", streams)
+	}
+
+	var stream StreamInfo
+	if err := json.Unmarshal(handle("GET", "/admin/streams/"+a.ID()).Body.Bytes(), &stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Queue != "a" {
+		t.Errorf("unexpected stream %v", stream)
+	}
+
+	samples := []struct {
+		method string
+		target string
+		expect int
+	}{
+		{method: "GET", target: "/admin/streams/unknown", expect: 404},
+		{method: "DELETE", target: "/admin/streams", expect: 400},
+		{method: "POST", target: "/admin/streams", expect: 405},
+		{method: "DELETE", target: "/admin/streams/" + a.ID() + "?event=closed&data=bye", expect: 204},
+		{method: "DELETE", target: "/admin/streams?queue=b", expect: 200},
+	}
+	for _, sample := range samples {
+		if code := handle(sample.method, sample.target).Code; code != sample.expect {
+			t.Errorf("%s %s: expected %d, got %d", sample.method, sample.target, sample.expect, code)
+		}
+	}
+
+	if final := a.Final(); final == nil || final.String() != "event: closed\ndata: bye\n" {
+		t.Errorf("unexpected final event %v", final)
+	}
+	if _, ok := <-b.Done(); ok || b.Final() != nil {
+		t.Error("expected closed stream without final event")
+	}
+}
+
+// Must manage queues through the broker connection
+func TestQueuesHandler_Handle(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	conn, _ := broker.DialMemory("memory://test-queues-handler")
+	memory := broker.OpenMemory("test-queues-handler")
+
+	brConn := make(chan broker.Connection)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case brConn <- conn:
+			case <-done:
+				return
+			}
+		}
+	}()
+	h := NewQueuesHandler(brConn, 0)
+
+	samples := []struct {
+		method string
+		target string
+		expect int
+		info   broker.QueueInfo
+	}{
+		{method: "GET", target: "/admin/queues/a%2Fb", expect: 404},
+		{method: "PUT", target: "/admin/queues/a%2Fb", expect: 200, info: broker.QueueInfo{Name: "a/b"}},
+		{method: "GET", target: "/admin/queues/a%2Fb", expect: 200, info: broker.QueueInfo{Name: "a/b", Messages: 2}},
+		{method: "DELETE", target: "/admin/queues/a%2Fb/messages", expect: 200, info: broker.QueueInfo{Name: "a/b", Messages: 2}},
+		{method: "DELETE", target: "/admin/queues/a%2Fb", expect: 200, info: broker.QueueInfo{Name: "a/b"}},
+		{method: "DELETE", target: "/admin/queues/a%2Fb", expect: 404},
+		{method: "PUT", target: "/admin/queues/amq.q", expect: 400},
+		{method: "PUT", target: "/admin/queues/", expect: 400},
+		{method: "GET", target: "/admin/queues/q/messages", expect: 405},
+		{method: "POST", target: "/admin/queues/q", expect: 405},
+		{method: "GET", target: "/admin/queues/q/x", expect: 404},
+	}
+
+	for i, sample := range samples {
+		recorder := httptest.NewRecorder()
+		h.Handle(recorder, httptest.NewRequest(sample.method, sample.target, nil))
+
+		if recorder.Code != sample.expect {
+			t.Errorf("%d: expected %d, got %d", i, sample.expect, recorder.Code)
+		}
+		if recorder.Code == 200 {
+			var info broker.QueueInfo
+			if err := json.Unmarshal(recorder.Body.Bytes(), &info); err != nil || info != sample.info {
+				t.Errorf("%d: expected %v, got %v", i, sample.info, info)
+			}
+		}
+		if i == 1 {
+			_ = memory.Publish("a/b", []byte("foo"))
+			_ = memory.Publish("a/b", []byte("bar"))
+		}
+	}
+}
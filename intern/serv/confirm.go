@@ -0,0 +1,108 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+type (
+	// Confirmation tracks deliveries awaiting the client's confirmation.
+	// Tokens are held in process, so confirmations must reach the
+	// instance serving the stream.
+	Confirmation interface {
+		Expect() (string, <-chan struct{})
+		Confirm(token string) bool
+		Forget(token string)
+	}
+	confirmation struct {
+		mu      sync.Mutex
+		pending map[string]chan struct{}
+	}
+
+	confirmHandler struct {
+		handler
+		confirm Confirmation
+	}
+)
+
+var errNoToken = errors.New("unknown delivery token")
+
+// NewConfirmation ...
+func NewConfirmation() Confirmation {
+	return &confirmation{pending: map[string]chan struct{}{}}
+}
+
+// Expect issues a delivery token. The returned channel is closed when the
+// token gets confirmed.
+func (c *confirmation) Expect() (string, <-chan struct{}) {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	token := hex.EncodeToString(b)
+	confirmed := make(chan struct{})
+
+	c.mu.Lock()
+	c.pending[token] = confirmed
+	c.mu.Unlock()
+
+	return token, confirmed
+}
+
+// Confirm ...
+func (c *confirmation) Confirm(token string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	confirmed, ok := c.pending[token]
+	if ok {
+		close(confirmed)
+		delete(c.pending, token)
+	}
+	return ok
+}
+
+// Forget ...
+func (c *confirmation) Forget(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, token)
+}
+
+// NewConfirmHandler creates the handler clients POST delivery tokens to.
+// Tokens issued by another instance are answered with 404 Not Found.
+// Cross-origin clients are allowed to POST, whatever methods the CORS
+// header allows the streams.
+func NewConfirmHandler(confirm Confirmation, header *ResponseHeader) ResponseHandler {
+	if header != nil && len(header.CORS) > 0 {
+		cors := make(map[string]string, len(header.CORS)+1)
+		for k, v := range header.CORS {
+			cors[k] = v
+		}
+		cors["Access-Control-Allow-Methods"] = "POST, OPTIONS"
+		header = &ResponseHeader{CORS: cors, SSE: header.SSE}
+	}
+	return &confirmHandler{handler: handler{header: header}, confirm: confirm}
+}
+
+// Handle ...
+func (h *confirmHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		h.sendStatus(w, http.StatusNoContent, nil)
+		return
+	}
+	if r.Method != "POST" {
+		h.sendStatus(w, http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if !h.confirm.Confirm(r.FormValue("id")) {
+		h.sendStatus(w, http.StatusNotFound, errNoToken)
+		return
+	}
+	h.sendStatus(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,78 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// Must issue tokens confirmable once
+func TestConfirmation(t *testing.T) {
+	c := NewConfirmation()
+
+	token, confirmed := c.Expect()
+
+	if token == "" {
+		t.Errorf("unexpected token %s", token)
+	}
+	if c.Confirm("1-0") {
+		t.Error("expected unknown token")
+	}
+	if !c.Confirm(token) {
+		t.Error("expected known token")
+	}
+	if _, ok := <-confirmed; ok {
+		t.Error("expected closed channel")
+	}
+	if c.Confirm(token) {
+		t.Error("expected token to be confirmable once")
+	}
+
+	token, _ = c.Expect()
+	c.Forget(token)
+
+	if c.Confirm(token) {
+		t.Errorf("unexpected token %s", token)
+	}
+}
+
+// Must answer confirmation requests
+func TestConfirmHandler_Handle(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	c := NewConfirmation()
+	token, _ := c.Expect()
+	h := NewConfirmHandler(c, &ResponseHeader{})
+
+	samples := []struct {
+		method string
+		query  string
+		expect int
+	}{
+		{method: "OPTIONS", expect: 204},
+		{method: "GET", query: "id=" + token, expect: 405},
+		{method: "POST", query: "id=unknown", expect: 404},
+		{method: "POST", query: "id=" + token, expect: 204},
+		{method: "POST", query: "id=" + token, expect: 404},
+	}
+
+	for _, sample := range samples {
+		recorder := httptest.NewRecorder()
+		request := &http.Request{
+			Method: sample.method,
+			URL:    &url.URL{RawQuery: sample.query},
+		}
+		h.Handle(recorder, request)
+
+		if recorder.Code != sample.expect {
+			t.Errorf("expected %d, got %d", sample.expect, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"regexp"
+)
+
+type (
+	// Group ...
+	Group interface {
+		Apply(queue string) string
+	}
+	group struct {
+		regEx *regexp.Regexp
+	}
+)
+
+// otherGroup collects the queue names not matching the group expression.
+const otherGroup = "other"
+
+// NewGroup maps queue names to the group their streams are accounted for
+// in the metrics: the first submatch of the regular expression, or the
+// whole match without submatches. An empty expression makes one group.
+func NewGroup(expr string) (Group, error) {
+	if expr == "" {
+		return &group{}, nil
+	}
+	regEx, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &group{regEx: regEx}, nil
+}
+
+// Apply ...
+func (g *group) Apply(queue string) string {
+	if g.regEx == nil {
+		return ""
+	}
+	match := g.regEx.FindStringSubmatch(queue)
+	switch {
+	case match == nil:
+		return otherGroup
+	case len(match) > 1:
+		return match[1]
+	default:
+		return match[0]
+	}
+}
@@ -0,0 +1,37 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"testing"
+)
+
+// Must derive the metric group from the queue name
+func TestGroup_Apply(t *testing.T) {
+
+	samples := []struct {
+		expr   string
+		queue  string
+		expect string
+	}{
+		{expr: "", queue: "tenant-a.user-1", expect: ""},
+		{expr: `^tenant-[^.]+`, queue: "tenant-a.user-1", expect: "tenant-a"},
+		{expr: `^tenant-([^.]+)\.`, queue: "tenant-a.user-1", expect: "a"},
+		{expr: `^tenant-([^.]+)\.`, queue: "user-1", expect: "other"},
+		{expr: `^(feed)?-`, queue: "-1", expect: ""},
+	}
+
+	for _, sample := range samples {
+		g, err := NewGroup(sample.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := g.Apply(sample.queue); result != sample.expect {
+			t.Errorf("%s: expected %q, got %q", sample.expr, sample.expect, result)
+		}
+	}
+
+	if _, err := NewGroup("("); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -3,14 +3,21 @@
 package serv
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"os"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"eventsourced/intern/broker"
 	"eventsourced/intern/event"
 	"eventsourced/intern/metric"
-
-	"github.com/streadway/amqp"
 )
 
 type (
@@ -24,6 +31,21 @@ type (
 		pattern  Pattern
 		header   *ResponseHeader
 		metric   metric.Metric
+		options  *StreamOptions
+	}
+	// stream is the state of a request served by the handler, which holds
+	// the configuration only and may serve requests concurrently.
+	stream struct {
+		*handler
+		ctx       context.Context
+		log       *slog.Logger
+		meter     *meter
+		slow      bool
+		labels    metric.Labels
+		queue     string
+		delivered int
+		session   Session
+		reason    string
 	}
 
 	// ResponseHeader ...
@@ -31,6 +53,89 @@ type (
 		CORS map[string]string
 		SSE  map[string]string
 	}
+
+	// StreamOptions ...
+	StreamOptions struct {
+		// Confirm enables end-to-end acknowledgements: a message is acked
+		// after the client POSTed its delivery token, and delivered again
+		// when not confirmed within ConfirmTimeout.
+		Confirm        Confirmation
+		ConfirmTimeout time.Duration
+
+		// Prefetch is the maximum number of ready messages written with
+		// a single flush.
+		Prefetch int
+
+		// Redeliver limits the redeliveries of a message failed to write,
+		// once exhausted it is rejected for dead lettering. Zero requeues
+		// forever.
+		Redeliver int
+
+		// Heartbeat is the interval of comments sent to keep intermediaries
+		// from closing the stream and to detect dead clients.
+		Heartbeat time.Duration
+		// WriteTimeout is the deadline for each write and flush.
+		WriteTimeout time.Duration
+		// MaxIdle closes streams without messages for that long, the client
+		// is told to reconnect after Retry.
+		MaxIdle time.Duration
+		Retry   time.Duration
+
+		// MinThroughput is the floor in bytes per second a client must
+		// accept while writes block, SlowPolicy the measure taken below.
+		MinThroughput int
+		SlowPolicy    string
+
+		// Drain is closed on shutdown. Streams end with a retry hint then,
+		// its delay randomized by up to RetryJitter, so reconnects spread
+		// across the remaining instances.
+		Drain       <-chan struct{}
+		RetryJitter time.Duration
+
+		// Node and Group label the metrics of the stream by the broker
+		// node consumed from and by the group of the queue name.
+		Node  string
+		Group Group
+
+		// TimestampHeader names the message header holding the publish
+		// time, the timestamp of the broker applies without. StampLatency
+		// adds the publish-to-flush latency as comment to each event.
+		TimestampHeader string
+		StampLatency    bool
+
+		// Tracer starts the spans of the stream and of each delivery,
+		// spans are not recorded without.
+		Tracer trace.Tracer
+
+		// Logger receives the records of the stream, tagged with the
+		// request. Every LogMessages-th delivered message is logged,
+		// none with zero.
+		Logger      *slog.Logger
+		LogMessages int
+
+		// Limiter bounds the number of open streams, requests beyond are
+		// answered with 503.
+		Limiter Limiter
+
+		// Registry lists the open streams, which may be closed through it.
+		Registry Registry
+
+		// Presence publishes the opening and closing of the stream, along
+		// with the Claims resolved from the request.
+		Presence Presence
+		Claims   Claims
+
+		// Webhook authorizes the stream before it opens, and is called
+		// after it closed.
+		Webhook Webhook
+	}
+)
+
+// Policies for clients below the throughput floor: disconnect ends the
+// stream with a retry hint, shed rejects the messages delivered ahead.
+const (
+	SlowDisconnect = "disconnect"
+	SlowShed       = "shed"
 )
 
 // NewServerSentHandler ...
@@ -40,22 +145,23 @@ func NewServerSentHandler(
 	producer event.Producer,
 	header *ResponseHeader,
 	metric metric.Metric,
+	options *StreamOptions,
 ) ResponseHandler {
+	if options == nil {
+		options = &StreamOptions{}
+	}
 	return &handler{
 		consumer: consumer,
 		pattern:  pattern,
 		producer: producer,
 		header:   header,
 		metric:   metric,
+		options:  options,
 	}
 }
 
 // Handle ...
 func (h *handler) Handle(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var queue string
-	var messages <-chan amqp.Delivery
-
 	if r.Method == "OPTIONS" {
 		h.sendStatus(w, http.StatusNoContent, nil)
 		return
@@ -64,50 +170,526 @@ func (h *handler) Handle(w http.ResponseWriter, r *http.Request) {
 		h.sendStatus(w, http.StatusMethodNotAllowed, nil)
 		return
 	}
-	if queue, err = h.pattern.Apply(r); err != nil {
-		h.sendStatus(w, http.StatusServiceUnavailable, err)
+	if h.options == nil {
+		c := *h
+		c.options = &StreamOptions{}
+		h = &c
+	}
+	s := &stream{handler: h, meter: newMeter(h.options.MinThroughput)}
+	s.serve(w, r)
+}
+
+// serve streams the messages of the queue resolved from the request.
+func (s *stream) serve(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var queue string
+	var messages <-chan broker.Message
+
+	reqID := requestID(w, r)
+	s.log = s.logger().With(
+		"request_id", reqID,
+		"remote_addr", r.RemoteAddr,
+	)
+
+	span := s.startStream(r)
+	defer span.End()
+
+	resolve := s.startSpan("resolve queue")
+	queue, err = s.pattern.Apply(r)
+	endSpan(resolve, err)
+
+	if err != nil {
+		traceError(span, err)
+		s.sendStatus(w, http.StatusServiceUnavailable, err)
 		return
 	}
-	if messages, err = h.consumer.Consume(queue); err != nil {
-		h.sendStatus(w, http.StatusServiceUnavailable, err)
+
+	e := PresenceEvent{
+		Queue:      queue,
+		Claims:     s.options.Claims.Apply(r),
+		RequestID:  reqID,
+		RemoteAddr: r.RemoteAddr,
+		Node:       s.options.Node,
+	}
+	if s.options.Webhook != nil {
+		authorize := s.startSpan("authorize")
+		queue, err = s.options.Webhook.Authorize(s.ctx, e)
+		endSpan(authorize, err)
+
+		var denied *DeniedError
+		if errors.As(err, &denied) {
+			traceError(span, err)
+			s.sendStatus(w, http.StatusForbidden, err)
+			return
+		}
+		if err != nil {
+			traceError(span, err)
+			s.sendStatus(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		e.Queue = queue
+	}
+	s.queue = queue
+	s.labels = metric.Labels{Node: s.options.Node}
+	if s.options.Group != nil {
+		s.labels.Group = s.options.Group.Apply(queue)
+	}
+	s.log = s.log.With("queue", queue, "node", s.labels.Node)
+	span.SetAttributes(
+		attribute.String("messaging.destination.name", queue),
+		attribute.String("eventsourced.node", s.labels.Node),
+		attribute.String("eventsourced.group", s.labels.Group),
+	)
+
+	// A confirming client sends the token of a delivery possibly not yet
+	// confirmed, resuming after it would drop the message. Unconfirmed
+	// messages are unacked and delivered again anyway.
+	lastID := r.Header.Get("Last-Event-ID")
+	if s.confirming() {
+		lastID = ""
+	}
+
+	if s.options.Limiter != nil {
+		if !s.options.Limiter.Acquire() {
+			traceError(span, errMaxStreams)
+			s.sendStatus(w, http.StatusServiceUnavailable, errMaxStreams)
+			return
+		}
+		defer s.options.Limiter.Release()
+	}
+
+	consume := s.startSpan("consume")
+	messages, err = s.consumer.Consume(queue, lastID)
+	endSpan(consume, err)
+
+	if err != nil {
+		traceError(span, err)
+		s.sendStatus(w, http.StatusServiceUnavailable, err)
 		return
 	}
 
-	h.setHeader(w, h.header.SSE)
-	h.setHeader(w, h.header.CORS)
-	h.sendBanner(w)
+	s.setHeader(w, s.header.SSE)
+	s.setHeader(w, s.header.CORS)
+	s.sendBanner(w)
+	defer s.clearDeadline(w)
 
-	brokerClose := h.consumer.Notify(make(chan error))
-	defer h.consumer.Ignore(brokerClose)
+	s.metric.IncRequestCount(http.StatusOK)
+	s.metric.IncConsumerCount(s.labels)
+	defer s.metric.DecConsumerCount(s.labels)
 
-	clientClose := r.Context().Done()
+	if s.options.Registry != nil {
+		s.session = s.options.Registry.Register(StreamInfo{
+			RequestID:  reqID,
+			Queue:      queue,
+			RemoteAddr: r.RemoteAddr,
+			Node:       s.labels.Node,
+			Group:      s.labels.Group,
+		})
+		defer s.session.Unregister()
+		s.log = s.log.With("stream_id", s.session.ID())
+	}
+
+	s.reason = reasonAborted
+	s.log.Info("stream: opened")
+	defer func(start time.Time) {
+		s.metric.ObserveStreamDuration(time.Since(start))
+		s.log.Info("stream: closed", "duration", time.Since(start), "delivered", s.delivered, "reason", s.reason)
+	}(time.Now())
 
-	deliver := func(msg []byte) error {
-		ev := h.producer.ServerSentEvent(msg).String()
-		if _, err := fmt.Fprintln(w, ev); err != nil {
-			return err
+	e.Connected = time.Now()
+	if s.options.Presence != nil {
+		s.options.Presence.Connected(e)
+	}
+	defer func() {
+		e.Reason, e.Delivered = s.reason, s.delivered
+		if s.options.Presence != nil {
+			s.options.Presence.Disconnected(e)
 		}
-		w.(http.Flusher).Flush()
-		return nil
+		if s.options.Webhook != nil {
+			s.options.Webhook.Closed(e)
+		}
+	}()
+
+	brokerClose := s.consumer.Notify(make(chan error))
+	defer s.consumer.Ignore(brokerClose)
+
+	clientClose := r.Context().Done()
+
+	var heartbeat, idle <-chan time.Time
+	var idleTimer *time.Timer
+
+	if s.options.Heartbeat > 0 {
+		ticker := time.NewTicker(s.options.Heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	if s.options.MaxIdle > 0 {
+		idleTimer = time.NewTimer(s.options.MaxIdle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
 	}
 
 	for {
 		select {
-		case message := <-messages:
-			if err := deliver(message.Body); err != nil {
-				continue
+		case message, ok := <-messages:
+			if !ok {
+				s.reason = reasonBroker
+				return
+			}
+			if s.confirming() {
+				if !s.awaitConfirm(w, message, heartbeat, brokerClose, clientClose) {
+					s.drained(w)
+					s.kicked(w)
+					return
+				}
+			} else if !s.deliverBatch(w, s.drain(message, messages)) {
+				s.reason = reasonWrite
+				return
+			}
+			if s.slow && !s.evict(w, messages) {
+				return
+			}
+			if idleTimer != nil {
+				if !idleTimer.Stop() {
+					select {
+					case <-idleTimer.C:
+					default:
+					}
+				}
+				idleTimer.Reset(s.options.MaxIdle)
 			}
-			_ = message.Ack(false)
-			h.metric.IncDeliveryCount()
+
+		case _ = <-heartbeat:
+			if err := s.sendComment(w); err != nil {
+				s.timedOut(err)
+				s.reason = reasonWrite
+				return
+			}
+		case _ = <-idle:
+			_ = s.deliverRetry(w, s.options.Retry)
+			s.reason = reasonIdle
+			return
+		case _ = <-s.options.Drain:
+			s.drained(w)
+			s.reason = reasonDrain
+			return
+		case _ = <-s.closed():
+			s.kicked(w)
+			s.reason = reasonClosed
+			return
 
 		case _ = <-brokerClose:
+			s.reason = reasonBroker
 			return
 		case _ = <-clientClose:
+			s.reason = reasonClient
 			return
 		}
 	}
 }
 
+func (h *handler) confirming() bool {
+	return h.options != nil && h.options.Confirm != nil
+}
+
+// awaitConfirm delivers the message with a delivery token as event id and
+// repeats the delivery until confirmed, heartbeats are sent meanwhile.
+// Returns false when the stream ends meanwhile, the unacked message is
+// redelivered by the broker then.
+func (s *stream) awaitConfirm(
+	w http.ResponseWriter,
+	message broker.Message,
+	heartbeat <-chan time.Time,
+	brokerClose <-chan error,
+	clientClose <-chan struct{},
+) bool {
+	var delivered bool
+	received := time.Now()
+	token, confirmed := s.options.Confirm.Expect()
+	defer s.options.Confirm.Forget(token)
+
+	span := s.startDelivery(message)
+	defer span.End()
+
+	for {
+		start := time.Now()
+		n, err := s.deliver(w, token, message)
+		if err != nil {
+			traceError(span, err)
+			s.metric.IncAbortCount()
+			s.reject(message)
+			s.reason = reasonWrite
+			return false
+		}
+		span.AddEvent("flushed")
+
+		// Repeated deliveries count towards the throughput floor as well,
+		// a slow client is disconnected right away, shed once confirmed.
+		s.slow = s.meter.record(n, time.Since(start)) || s.slow
+		if s.slow && s.options.SlowPolicy != SlowShed {
+			return s.evict(w, nil)
+		}
+		if !delivered {
+			s.observePublished(message, time.Now())
+			delivered = true
+		}
+		timeout := time.NewTimer(s.options.ConfirmTimeout)
+
+	wait:
+		for {
+			select {
+			case <-confirmed:
+				timeout.Stop()
+				span.AddEvent("confirmed")
+				_ = message.Ack()
+				s.metric.IncAckCount()
+				s.metric.IncDeliveryCount(s.labels)
+				s.metric.ObserveDeliveryLatency(time.Since(received))
+				s.logDelivery(message)
+				return true
+
+			case <-timeout.C:
+				break wait
+			case _ = <-heartbeat:
+				// Keeps intermediaries from closing the stream while the
+				// client takes its time, extending the write deadline.
+				err := s.sendComment(w)
+				if err == nil {
+					continue
+				}
+				s.timedOut(err)
+				s.reason = reasonWrite
+			case _ = <-brokerClose:
+				s.reason = reasonBroker
+			case _ = <-clientClose:
+				s.reason = reasonClient
+			case _ = <-s.options.Drain:
+				s.reason = reasonDrain
+			case _ = <-s.closed():
+				s.reason = reasonClosed
+			}
+			timeout.Stop()
+			return false
+		}
+	}
+}
+
+// reject hands back a message the client could not be written to, the
+// client is gone then. A message exceeding the redelivery limit is
+// rejected without requeue, so the broker may dead-letter it. The abort
+// is counted by the caller, once per failed write.
+func (h *handler) reject(message broker.Message) {
+	if h.options != nil && h.options.Redeliver > 0 &&
+		message.Deliveries() > h.options.Redeliver {
+		_ = message.Nack(false)
+		h.metric.IncDeadLetterCount()
+		return
+	}
+	_ = message.Nack(true)
+	h.metric.IncRequeueCount()
+}
+
+// drain collects the messages ready along with the first one, up to the
+// prefetch count.
+func (h *handler) drain(first broker.Message, messages <-chan broker.Message) []broker.Message {
+	batch := []broker.Message{first}
+
+	for h.options != nil && len(batch) < h.options.Prefetch {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, message)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// deliverBatch writes the messages with a single flush and acks them, all
+// at once where supported. Returns false when the client is gone, none of
+// the messages counts as delivered then.
+func (s *stream) deliverBatch(w http.ResponseWriter, batch []broker.Message) bool {
+	var size int
+	start := time.Now()
+
+	spans := make([]trace.Span, len(batch))
+	for i, message := range batch {
+		spans[i] = s.startDelivery(message)
+	}
+
+	err := s.deadline(w)
+	for _, message := range batch {
+		if err == nil {
+			var n int
+			n, err = s.write(w, message.ID(), message)
+			size += n
+		}
+	}
+	if err == nil {
+		err = s.flush(w)
+	}
+	if err != nil {
+		s.timedOut(err)
+		s.metric.IncAbortCount()
+		for i, message := range batch {
+			s.reject(message)
+			endSpan(spans[i], err)
+		}
+		return false
+	}
+	flushed := time.Since(start)
+	s.metric.ObserveFlushTime(flushed)
+	s.slow = s.meter.record(size, flushed)
+
+	for i, message := range batch {
+		s.observePublished(message, start.Add(flushed))
+		spans[i].AddEvent("flushed")
+	}
+
+	last := batch[len(batch)-1]
+	if acker, ok := last.(broker.MultiAcker); ok {
+		_ = acker.AckMultiple()
+	} else {
+		for _, message := range batch {
+			_ = message.Ack()
+		}
+	}
+	latency := time.Since(start)
+	for i, message := range batch {
+		s.metric.IncAckCount()
+		s.metric.IncDeliveryCount(s.labels)
+		s.metric.ObserveDeliveryLatency(latency)
+		s.logDelivery(message)
+		spans[i].End()
+	}
+	return true
+}
+
+// timedOut counts clients evicted by the write deadline.
+func (h *handler) timedOut(err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		h.metric.IncEvictCount()
+	}
+}
+
+// evict applies the slow consumer policy. Returns false when the stream
+// is to be closed.
+func (s *stream) evict(w http.ResponseWriter, messages <-chan broker.Message) bool {
+	s.slow = false
+
+	if s.options.SlowPolicy != SlowShed {
+		s.metric.IncEvictCount()
+		_ = s.deliverRetry(w, s.options.Retry)
+		s.reason = reasonEvicted
+		return false
+	}
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				s.reason = reasonBroker
+				return false
+			}
+			_ = message.Nack(false)
+			s.metric.IncShedCount()
+		default:
+			return true
+		}
+	}
+}
+
+func (h *handler) deliver(w http.ResponseWriter, id string, message broker.Message) (int, error) {
+	_ = h.deadline(w)
+	n, err := h.write(w, id, message)
+	if err != nil {
+		return n, err
+	}
+	return n, h.flush(w)
+}
+
+// drained tells the client to reconnect elsewhere when draining.
+func (h *handler) drained(w http.ResponseWriter) {
+	select {
+	case <-h.options.Drain:
+		_ = h.deliverRetry(w, h.options.Retry+jitter(h.options.RetryJitter))
+	default:
+	}
+}
+
+// closed is closed when the stream is to be closed from outside, never
+// without registry.
+func (s *stream) closed() <-chan struct{} {
+	if s.session == nil {
+		return nil
+	}
+	return s.session.Done()
+}
+
+// kicked sends the final event, if any, when closed from outside.
+func (s *stream) kicked(w http.ResponseWriter) {
+	select {
+	case <-s.closed():
+	default:
+		return
+	}
+	s.log.Info("stream: force closed")
+
+	if final := s.session.Final(); final != nil {
+		_ = s.deadline(w)
+		if _, err := fmt.Fprintln(w, final.String()); err == nil {
+			_ = s.flush(w)
+		}
+	}
+}
+
+// deliverRetry tells the client when to reconnect, unless no delay is set.
+func (h *handler) deliverRetry(w http.ResponseWriter, retry time.Duration) error {
+	if retry <= 0 {
+		return nil
+	}
+	_ = h.deadline(w)
+	ev := h.producer.RetryEvent(retry).String()
+	if _, err := fmt.Fprintln(w, ev); err != nil {
+		return err
+	}
+	return h.flush(w)
+}
+
+// write sends the message as event with the given id, preceded by its
+// latency comment when enabled.
+func (h *handler) write(w http.ResponseWriter, id string, message broker.Message) (int, error) {
+	var stamp string
+	if h.options != nil && h.options.StampLatency {
+		if published := h.published(message); !published.IsZero() {
+			stamp = fmt.Sprintf(": latency %d\n", latency(published, time.Now())/time.Millisecond)
+		}
+	}
+	ev := h.producer.IdentifiedEvent(id, message.Body()).String()
+	return fmt.Fprintln(w, stamp+ev)
+}
+
+// published returns the publish time of a message, zero when unknown.
+func (h *handler) published(message broker.Message) time.Time {
+	var header string
+	if h.options != nil {
+		header = h.options.TimestampHeader
+	}
+	if t, ok := message.(broker.Timestamper); ok {
+		return t.Timestamp(header)
+	}
+	return time.Time{}
+}
+
+// observePublished records the publish-to-flush latency of a message.
+func (s *stream) observePublished(message broker.Message, flushed time.Time) {
+	if published := s.published(message); !published.IsZero() {
+		s.metric.ObservePublishLatency(s.labels.Group, latency(published, flushed))
+	}
+}
+
 func (h *handler) setHeader(w http.ResponseWriter, header map[string]string) {
 	for k, v := range header {
 		w.Header().Set(k, v)
@@ -115,18 +697,83 @@ func (h *handler) setHeader(w http.ResponseWriter, header map[string]string) {
 }
 
 func (h *handler) sendStatus(w http.ResponseWriter, status int, err error) {
+	h.writeStatus(w, status, err, h.logger())
+}
+
+// sendStatus answers the request, failures logged with its attributes.
+func (s *stream) sendStatus(w http.ResponseWriter, status int, err error) {
+	s.writeStatus(w, status, err, s.log)
+}
+
+func (h *handler) writeStatus(w http.ResponseWriter, status int, err error, log *slog.Logger) {
 	if status >= 400 && err != nil {
 		h.setHeader(w, map[string]string{
 			"X-Status-Reason": err.Error(),
 		})
-		log.Printf("server: status %d, %s", status, err.Error())
+		log.Warn("server: request failed", "status", status, "error", err)
 	}
 
 	h.setHeader(w, h.header.CORS)
 	w.WriteHeader(status)
+
+	if h.metric != nil {
+		h.metric.IncRequestCount(status)
+	}
 }
 
 func (h *handler) sendBanner(w http.ResponseWriter) {
+	_ = h.deadline(w)
 	_, _ = fmt.Fprintf(w, ": SSE stream\n\n")
-	w.(http.Flusher).Flush()
+	_ = h.flush(w)
+}
+
+func (h *handler) sendComment(w http.ResponseWriter) error {
+	_ = h.deadline(w)
+	if _, err := fmt.Fprintf(w, ":\n\n"); err != nil {
+		return err
+	}
+	return h.flush(w)
+}
+
+// deadline bounds the following writes and flush, where supported.
+func (h *handler) deadline(w http.ResponseWriter) error {
+	if h.options == nil || h.options.WriteTimeout <= 0 {
+		return nil
+	}
+	err := http.NewResponseController(w).
+		SetWriteDeadline(time.Now().Add(h.options.WriteTimeout))
+
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// clearDeadline lifts the deadline of the last write, so the response
+// is completed unbounded when the stream ends.
+func (h *handler) clearDeadline(w http.ResponseWriter) {
+	if h.options == nil || h.options.WriteTimeout <= 0 {
+		return
+	}
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+func (h *handler) flush(w http.ResponseWriter) error {
+	return http.NewResponseController(w).Flush()
+}
+
+// latency is the time between publish and flush, clocks of publishers
+// may be ahead.
+func latency(published, flushed time.Time) time.Duration {
+	if d := flushed.Sub(published); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
 }
@@ -3,26 +3,36 @@
 package serv
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"eventsourced/intern/broker"
 	"eventsourced/intern/event"
 	"eventsourced/intern/metric"
 	"eventsourced/intern/mock/serv"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/golang/mock/gomock"
-	"github.com/streadway/amqp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestServerSentEventHandler(t *testing.T) {
-	NewServerSentHandler(nil, nil, nil, nil, nil)
+	NewServerSentHandler(nil, nil, nil, nil, nil, nil)
 }
 
 // Must send HTTP 405 when method other than GET
@@ -89,7 +99,7 @@ func TestRequestHandler_Handle_4(t *testing.T) {
 	defer ctrl.Finish()
 
 	c := mock_serv.NewMockConsumer(ctrl)
-	c.EXPECT().Consume(gomock.Any()).Return(nil, errors.New(""))
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(nil, errors.New(""))
 
 	r := &handler{
 		consumer: c,
@@ -105,6 +115,20 @@ func TestRequestHandler_Handle_4(t *testing.T) {
 	}
 }
 
+type testMessage struct {
+	id         string
+	body       []byte
+	deliveries int
+	acked      int32
+	nacked     []bool
+}
+
+func (m *testMessage) ID() string        { return m.id }
+func (m *testMessage) Body() []byte      { return m.body }
+func (m *testMessage) Deliveries() int   { return m.deliveries }
+func (m *testMessage) Ack() error        { atomic.AddInt32(&m.acked, 1); return nil }
+func (m *testMessage) Nack(r bool) error { m.nacked = append(m.nacked, r); return nil }
+
 type badWriter struct{}
 
 func (w *badWriter) Header() http.Header        { return map[string][]string{} }
@@ -112,17 +136,20 @@ func (w *badWriter) Write([]byte) (int, error)  { return 0, errors.New("") }
 func (w *badWriter) WriteHeader(statusCode int) {}
 func (w *badWriter) Flush()                     {}
 
-// Must continue on delivery failure and answer complete request
+// Must requeue and stop on delivery failure, answer complete request
 func TestRequestHandler_Handle_5(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	{
-		d := make(chan amqp.Delivery, 2)
-		d <- amqp.Delivery{Body: []byte("foo")}
-		d <- amqp.Delivery{Body: []byte("bar")}
+		foo := &testMessage{body: []byte("foo"), deliveries: 1}
+		bar := &testMessage{body: []byte("bar"), deliveries: 1}
+
+		d := make(chan broker.Message, 2)
+		d <- foo
+		d <- bar
 
 		c := mock_serv.NewMockConsumer(ctrl)
-		c.EXPECT().Consume(gomock.Any()).Return(d, nil)
+		c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(d, nil)
 		c.EXPECT().Notify(gomock.Any())
 		c.EXPECT().Ignore(gomock.Any())
 		c.EXPECT().Close().Times(0)
@@ -139,14 +166,24 @@ func TestRequestHandler_Handle_5(t *testing.T) {
 			metric:   metric.NewMetric("test"),
 		}
 		r.Handle(&badWriter{}, request.WithContext(ctx))
+
+		if len(foo.nacked) != 1 || !foo.nacked[0] || foo.acked != 0 {
+			t.Errorf("expected requeue, got %v", foo.nacked)
+		}
+		if len(bar.nacked) != 0 || bar.acked != 0 {
+			t.Error("unexpected handling after delivery failure")
+		}
+		if stats := r.metric.Report().(metric.Stats); stats.Abort != 1 || stats.Requeue != 1 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
 	}
 	{
-		d := make(chan amqp.Delivery, 2)
-		d <- amqp.Delivery{Body: []byte("foo")}
-		d <- amqp.Delivery{Body: []byte("bar")}
+		d := make(chan broker.Message, 2)
+		d <- &testMessage{body: []byte("foo")}
+		d <- &testMessage{body: []byte("bar")}
 
 		c := mock_serv.NewMockConsumer(ctrl)
-		c.EXPECT().Consume(gomock.Any()).Return(d, nil)
+		c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(d, nil)
 		c.EXPECT().Notify(gomock.Any())
 		c.EXPECT().Ignore(gomock.Any())
 		c.EXPECT().Close().Times(0)
@@ -175,9 +212,49 @@ func TestRequestHandler_Handle_5(t *testing.T) {
 	}
 }
 
-type hiccupConsumer struct{ d chan amqp.Delivery }
+// Must reject messages exceeding the redelivery limit
+func TestRequestHandler_Handle_9(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	samples := []struct {
+		deliveries int
+		requeue    bool
+	}{
+		{deliveries: 1, requeue: true},
+		{deliveries: 2, requeue: true},
+		{deliveries: 3, requeue: false},
+	}
+
+	for _, sample := range samples {
+		message := &testMessage{body: []byte("foo"), deliveries: sample.deliveries}
+		d := make(chan broker.Message, 1)
+		d <- message
+
+		c := mock_serv.NewMockConsumer(ctrl)
+		c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(d, nil)
+		c.EXPECT().Notify(gomock.Any())
+		c.EXPECT().Ignore(gomock.Any())
+
+		h := NewServerSentHandler(
+			c,
+			NewPattern("-"),
+			event.NewProducer(),
+			&ResponseHeader{},
+			metric.NewMetric("test"),
+			&StreamOptions{Redeliver: 2},
+		)
+		h.Handle(&badWriter{}, &http.Request{Method: "GET"})
+
+		if len(message.nacked) != 1 || message.nacked[0] != sample.requeue {
+			t.Errorf("expected requeue %v, got %v", sample.requeue, message.nacked)
+		}
+	}
+}
+
+type hiccupConsumer struct{ d chan broker.Message }
 
-func (c *hiccupConsumer) Consume(string) (<-chan amqp.Delivery, error) {
+func (c *hiccupConsumer) Consume(string, string) (<-chan broker.Message, error) {
 	return c.d, nil
 }
 func (c *hiccupConsumer) Notify(err chan error) chan error {
@@ -205,3 +282,973 @@ func TestRequestHandler_Handle_6(t *testing.T) {
 
 	// What about an assertion?
 }
+
+// Must resume from Last-Event-ID and emit event ids
+func TestRequestHandler_Handle_7(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	d := make(chan broker.Message, 1)
+	d <- &testMessage{id: "2-0", body: []byte("foo")}
+	close(d)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume("-", "1-0").Return(d, nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	h := &handler{
+		consumer: c,
+		pattern:  NewPattern("-"),
+		producer: event.NewProducer(),
+		header:   &ResponseHeader{},
+		metric:   metric.NewMetric("test"),
+	}
+
+	request := &http.Request{
+		Method: "GET",
+		Header: http.Header{"Last-Event-Id": {"1-0"}},
+	}
+	recorder := httptest.NewRecorder()
+	h.Handle(recorder, request)
+
+	expect := ": SSE stream\n\nid: 2-0\ndata: foo\n\n"
+	result := recorder.Body.String()
+
+	if expect != result {
+		t.Errorf("unexpected response %s", result)
+	}
+}
+
+type syncRecorder struct {
+	sync.Mutex
+	*httptest.ResponseRecorder
+}
+
+func (r *syncRecorder) Write(b []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.ResponseRecorder.Write(b)
+}
+
+func (r *syncRecorder) String() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.Body.String()
+}
+
+// Must redeliver until confirmed, ack on confirmation only, not resume
+// after a delivery token
+func TestRequestHandler_Handle_8(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	message := &testMessage{id: "2-0", body: []byte("foo")}
+	d := make(chan broker.Message, 1)
+	d <- message
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume("-", "").Return(d, nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	confirm := NewConfirmation()
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("-"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{
+			Confirm:        confirm,
+			ConfirmTimeout: time.Millisecond * 100,
+		},
+	)
+
+	request := &http.Request{
+		Method: "GET",
+		Header: http.Header{"Last-Event-Id": {"0123abcd"}},
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), time.Second)
+	defer cancel()
+
+	recorder := &syncRecorder{ResponseRecorder: httptest.NewRecorder()}
+	done := make(chan struct{})
+	go func() { h.Handle(recorder, request.WithContext(ctx)); close(done) }()
+
+	time.Sleep(time.Millisecond * 250)
+
+	tokens := regexp.MustCompile(`id: ([0-9a-f]+)\n`).FindAllStringSubmatch(recorder.String(), -1)
+	if len(tokens) < 2 {
+		t.Fatalf("expected redelivery, got %s", recorder.String())
+	}
+	if atomic.LoadInt32(&message.acked) != 0 {
+		t.Error("unexpected ack before confirmation")
+	}
+
+	confirm.Confirm(tokens[0][1])
+	time.Sleep(time.Millisecond * 50)
+
+	if atomic.LoadInt32(&message.acked) != 1 {
+		t.Error("expected ack after confirmation")
+	}
+	cancel()
+	<-done
+}
+
+type multiMessage struct {
+	testMessage
+	multiple int32
+}
+
+func (m *multiMessage) AckMultiple() error { atomic.AddInt32(&m.multiple, 1); return nil }
+
+type countWriter struct {
+	*httptest.ResponseRecorder
+	writes  int
+	flushes int
+}
+
+func (w *countWriter) Write(b []byte) (int, error) { w.writes++; return len(b), nil }
+func (w *countWriter) Flush()                      { w.flushes++ }
+
+// Must write ready messages with a single flush and ack them at once
+func TestRequestHandler_Handle_10(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	foo := &multiMessage{testMessage: testMessage{body: []byte("foo")}}
+	bar := &multiMessage{testMessage: testMessage{body: []byte("bar")}}
+	baz := &multiMessage{testMessage: testMessage{body: []byte("baz")}}
+
+	d := make(chan broker.Message, 3)
+	d <- foo
+	d <- bar
+	d <- baz
+	close(d)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(d, nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("-"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{Prefetch: 2},
+	)
+
+	w := &countWriter{ResponseRecorder: httptest.NewRecorder()}
+	h.Handle(w, &http.Request{Method: "GET"})
+
+	// banner, foo and bar, baz
+	if w.writes != 4 || w.flushes != 3 {
+		t.Errorf("expected 4 writes and 3 flushes, got %d and %d", w.writes, w.flushes)
+	}
+	if foo.multiple != 0 || bar.multiple != 1 || baz.multiple != 1 {
+		t.Errorf("unexpected acks %d %d %d", foo.multiple, bar.multiple, baz.multiple)
+	}
+}
+
+type benchWriter struct {
+	*httptest.ResponseRecorder
+	events int
+	expect int
+	cancel context.CancelFunc
+}
+
+func (w *benchWriter) Write(b []byte) (int, error) {
+	if bytes.HasPrefix(b, []byte("data:")) {
+		if w.events++; w.events == w.expect {
+			w.cancel()
+		}
+	}
+	return len(b), nil
+}
+
+func (w *benchWriter) Flush() {}
+
+func benchmarkHandler(b *testing.B, prefetch int) {
+	log.SetOutput(ioutil.Discard)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	name := "bench-" + strconv.Itoa(prefetch)
+	memory := broker.OpenMemory(name)
+	_ = memory.Declare("q", 0)
+	defer func() { _ = memory.Delete("q") }()
+
+	for i := 0; i < b.N; i++ {
+		_ = memory.Publish("q", []byte("foo"))
+	}
+
+	conn, _ := broker.DialMemory("memory://" + name)
+	consumer := NewConsumer(conn, 0, prefetch)
+	defer func() { _ = consumer.Close() }()
+
+	h := NewServerSentHandler(
+		consumer,
+		NewPattern("q"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("bench"),
+		&StreamOptions{Prefetch: prefetch},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &benchWriter{ResponseRecorder: httptest.NewRecorder(), expect: b.N, cancel: cancel}
+	request := (&http.Request{Method: "GET"}).WithContext(ctx)
+
+	b.ResetTimer()
+	h.Handle(w, request)
+}
+
+func BenchmarkRequestHandler_Prefetch_1(b *testing.B)   { benchmarkHandler(b, 1) }
+func BenchmarkRequestHandler_Prefetch_16(b *testing.B)  { benchmarkHandler(b, 16) }
+func BenchmarkRequestHandler_Prefetch_128(b *testing.B) { benchmarkHandler(b, 128) }
+
+// Must send heartbeats and close idle stream with retry hint
+func TestRequestHandler_Handle_11(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(make(chan broker.Message), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("-"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{
+			Heartbeat:    time.Millisecond * 20,
+			WriteTimeout: time.Second,
+			MaxIdle:      time.Millisecond * 110,
+			Retry:        time.Second * 2,
+		},
+	)
+
+	request := &http.Request{Method: "GET"}
+	ctx, cancel := context.WithTimeout(request.Context(), time.Second)
+	defer cancel()
+
+	recorder := httptest.NewRecorder()
+	h.Handle(recorder, request.WithContext(ctx))
+
+	if ctx.Err() != nil {
+		t.Error("expected stream to be closed on idle")
+	}
+
+	result := recorder.Body.String()
+	if !strings.HasPrefix(result, ": SSE stream\n\n:\n\n") {
+		t.Errorf("expected heartbeats, got %q", result)
+	}
+	if !strings.HasSuffix(result, ":\n\nretry: 2000\n\n") {
+		t.Errorf("expected retry hint, got %q", result)
+	}
+}
+
+type slowWriter struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	time.Sleep(time.Millisecond * 10)
+	return w.ResponseRecorder.Write(b)
+}
+
+// Must evict clients exceeding the write deadline or below the throughput floor
+func TestRequestHandler_Handle_12(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	samples := []struct {
+		policy string
+		err    error
+		evict  int64
+		shed   bool
+	}{
+		{err: os.ErrDeadlineExceeded, evict: 1},
+		{policy: SlowDisconnect, evict: 1},
+		{policy: SlowShed, shed: true},
+	}
+
+	for _, sample := range samples {
+		d := make(chan broker.Message, 500)
+		for i := 0; i < cap(d); i++ {
+			d <- &testMessage{body: []byte("foo"), deliveries: 1}
+		}
+		close(d)
+
+		c := mock_serv.NewMockConsumer(ctrl)
+		c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(d, nil)
+		c.EXPECT().Notify(gomock.Any())
+		c.EXPECT().Ignore(gomock.Any())
+
+		m := metric.NewMetric("test")
+		h := NewServerSentHandler(
+			c,
+			NewPattern("-"),
+			event.NewProducer(),
+			&ResponseHeader{},
+			m,
+			&StreamOptions{
+				Prefetch:      8,
+				MinThroughput: 1 << 20,
+				SlowPolicy:    sample.policy,
+				Retry:         time.Second,
+			},
+		)
+
+		w := &slowWriter{ResponseRecorder: httptest.NewRecorder(), err: sample.err}
+		h.Handle(w, &http.Request{Method: "GET"})
+
+		stats := m.Report().(metric.Stats)
+		if stats.Evict != sample.evict || (stats.Shed > 0) != sample.shed {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+		if sample.policy == SlowDisconnect && !strings.HasSuffix(w.Body.String(), "retry: 1000\n\n") {
+			t.Errorf("expected retry hint, got %q", w.Body.String())
+		}
+	}
+}
+
+// Must end streams on drain with a randomized retry hint
+func TestRequestHandler_Handle_13(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	drain := make(chan struct{})
+	close(drain)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(make(chan broker.Message), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("-"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{
+			Drain:       drain,
+			Retry:       time.Second,
+			RetryJitter: time.Second,
+		},
+	)
+
+	recorder := httptest.NewRecorder()
+	h.Handle(recorder, &http.Request{Method: "GET"})
+
+	match := regexp.MustCompile(`\nretry: (\d+)\n\n$`).FindStringSubmatch(recorder.Body.String())
+	if match == nil {
+		t.Fatalf("expected retry hint, got %q", recorder.Body.String())
+	}
+	if retry, _ := strconv.Atoi(match[1]); retry < 1000 || retry >= 2000 {
+		t.Errorf("expected retry within jitter, got %d", retry)
+	}
+}
+
+// Must account the stream to its broker node and queue group
+func TestRequestHandler_Handle_14(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	messages := make(chan broker.Message, 2)
+	messages <- &testMessage{body: []byte("foo")}
+	messages <- &testMessage{body: []byte("bar")}
+	close(messages)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return((<-chan broker.Message)(messages), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	group, _ := NewGroup(`^tenant-(\w+)`)
+	m := metric.NewMetric("test")
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("tenant-a.user-1"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		m,
+		&StreamOptions{Node: "10.0.0.11:5672", Group: group},
+	)
+	h.Handle(httptest.NewRecorder(), &http.Request{Method: "GET"})
+
+	stats := m.Report().(metric.Stats)
+
+	if n := stats.Node["10.0.0.11:5672"]; n.Delivery != 2 || n.Consumer != 0 {
+		t.Errorf("unexpected node breakdown %+v", n)
+	}
+	if g := stats.Group["a"]; g.Delivery != 2 {
+		t.Errorf("unexpected group breakdown %+v", g)
+	}
+}
+
+type stampedMessage struct {
+	testMessage
+	published time.Time
+}
+
+func (m *stampedMessage) Timestamp(header string) time.Time {
+	if header != "x-published" {
+		return time.Time{}
+	}
+	return m.published
+}
+
+// Must measure publish-to-flush latency and stamp it as comment
+func TestRequestHandler_Handle_15(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	messages := make(chan broker.Message, 2)
+	messages <- &stampedMessage{testMessage{body: []byte("foo")}, time.Now().Add(-time.Second)}
+	messages <- &testMessage{body: []byte("bar")}
+	close(messages)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return((<-chan broker.Message)(messages), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	group, _ := NewGroup(`^\w+`)
+	m := metric.NewMetric("test")
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("feed"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		m,
+		&StreamOptions{Group: group, TimestampHeader: "x-published", StampLatency: true},
+	)
+
+	recorder := httptest.NewRecorder()
+	h.Handle(recorder, &http.Request{Method: "GET"})
+
+	if !regexp.MustCompile(`\n: latency 1\d\d\d\ndata: foo\n\ndata: bar\n\n$`).MatchString(recorder.Body.String()) {
+		t.Errorf("unexpected body %q", recorder.Body.String())
+	}
+
+	buf := &bytes.Buffer{}
+	_ = m.WritePrometheus(buf)
+
+	for _, expect := range []string{
+		"test_publish_latency_seconds_bucket{group=\"feed\",le=\"0.5\"} 0\n",
+		"test_publish_latency_seconds_bucket{group=\"feed\",le=\"2.5\"} 1\n",
+		"test_publish_latency_seconds_count{group=\"feed\"} 1\n",
+	} {
+		if !strings.Contains(buf.String(), expect) {
+			t.Errorf("expected %q in\n%s", expect, buf.String())
+		}
+	}
+}
+
+type tracedMessage struct {
+	testMessage
+	header map[string]string
+}
+
+func (m *tracedMessage) Header(key string) string { return m.header[key] }
+
+// Must continue the traces of request and publisher
+func TestRequestHandler_Handle_16(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	publisher := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	request := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	messages := make(chan broker.Message, 2)
+	messages <- &tracedMessage{testMessage{id: "1", body: []byte("foo")}, map[string]string{"traceparent": publisher}}
+	messages <- &testMessage{id: "2", body: []byte("bar")}
+	close(messages)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return((<-chan broker.Message)(messages), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("q"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{Prefetch: 2, Tracer: provider.Tracer("test")},
+	)
+	r := &http.Request{Method: "GET", Header: http.Header{"Traceparent": []string{request}}}
+	h.Handle(httptest.NewRecorder(), r)
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		key := span.Name
+		for _, kv := range span.Attributes {
+			if kv.Key == "messaging.message.id" {
+				key += " " + kv.Value.AsString()
+			}
+		}
+		spans[key] = span
+	}
+	if len(spans) != 5 {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+
+	stream := spans["stream"]
+	if stream.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("expected request trace, got %s", stream.SpanContext.TraceID())
+	}
+	for _, name := range []string{"resolve queue", "consume", "deliver 2"} {
+		if spans[name].Parent.SpanID() != stream.SpanContext.SpanID() {
+			t.Errorf("expected %s within stream", name)
+		}
+	}
+
+	deliver := spans["deliver 1"]
+	if deliver.Parent.SpanID().String() != "b7ad6b7169203331" {
+		t.Errorf("expected publisher trace, got parent %s", deliver.Parent.SpanID())
+	}
+	if len(deliver.Links) != 1 || deliver.Links[0].SpanContext.SpanID() != stream.SpanContext.SpanID() {
+		t.Errorf("expected link to stream, got %v", deliver.Links)
+	}
+	if len(deliver.Events) != 1 || deliver.Events[0].Name != "flushed" {
+		t.Errorf("unexpected events %v", deliver.Events)
+	}
+}
+
+// Must log the stream with request fields and every n-th message
+func TestRequestHandler_Handle_17(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	messages := make(chan broker.Message, 3)
+	for _, id := range []string{"1", "2", "3"} {
+		messages <- &testMessage{id: id, body: []byte("foo")}
+	}
+	close(messages)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return((<-chan broker.Message)(messages), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	buf := &bytes.Buffer{}
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey || a.Key == "duration" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("q"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{Node: "n0:5672", Logger: logger, LogMessages: 2},
+	)
+	recorder := httptest.NewRecorder()
+	request := &http.Request{Method: "GET", RemoteAddr: "10.0.0.1:1234", Header: http.Header{
+		"X-Request-Id": []string{"req-1"},
+	}}
+	h.Handle(recorder, request)
+
+	if id := recorder.Header().Get("X-Request-ID"); id != "req-1" {
+		t.Errorf("expected request id, got %q", id)
+	}
+
+	fields := "request_id=req-1 remote_addr=10.0.0.1:1234 queue=q node=n0:5672"
+	expect := "level=INFO msg=\"stream: opened\" " + fields + "\n" +
+		"level=INFO msg=\"stream: delivered\" " + fields + " message_id=2 deliveries=0 bytes=3\n" +
+		"level=INFO msg=\"stream: closed\" " + fields + " delivered=3 reason=broker\n"
+
+	if buf.String() != expect {
+		t.Errorf("expected\n%s\ngot\n%s", expect, buf.String())
+	}
+}
+
+// Must generate a request id unless a valid one is given
+func TestRequestID(t *testing.T) {
+	for _, given := range []string{"", "bad id\n", strings.Repeat("x", 129)} {
+		recorder := httptest.NewRecorder()
+		id := requestID(recorder, &http.Request{Header: http.Header{"X-Request-Id": []string{given}}})
+
+		if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(id) || recorder.Header().Get("X-Request-ID") != id {
+			t.Errorf("%q: unexpected request id %q", given, id)
+		}
+	}
+}
+
+// Must register the stream and end it when closed through the registry
+func TestRequestHandler_Handle_18(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	messages := make(chan broker.Message, 1)
+	messages <- &testMessage{id: "1", body: []byte("foo")}
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return((<-chan broker.Message)(messages), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	registry := NewRegistry()
+	h := NewServerSentHandler(
+		c,
+		NewPattern("q"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{Node: "n0:5672", Registry: registry},
+	)
+
+	recorder := &syncRecorder{ResponseRecorder: httptest.NewRecorder()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Handle(recorder, &http.Request{Method: "GET", RemoteAddr: "10.0.0.1:1234"})
+	}()
+
+	var streams []StreamInfo
+	for i := 0; i < 100; i++ {
+		if streams = registry.Streams(); len(streams) == 1 && streams[0].Delivered == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(streams) != 1 {
+		t.Fatalf("expected registered stream, got %v", streams)
+	}
+	s := streams[0]
+	if s.Queue != "q" || s.Node != "n0:5672" || s.RemoteAddr != "10.0.0.1:1234" || s.Delivered != 1 {
+		t.Errorf("unexpected stream %+v", s)
+	}
+
+	if registry.CloseQueue("q", event.NewProducer().NamedEvent("closed", []byte("bye"))) != 1 {
+		t.Error("expected stream to be closed")
+	}
+	<-done
+
+	if !strings.HasSuffix(recorder.String(), "data: foo\n\nevent: closed\ndata: bye\n\n") {
+		t.Errorf("expected final event, got %q", recorder.String())
+	}
+	if _, ok := registry.Stream(s.ID); ok {
+		t.Error("expected stream to be unregistered")
+	}
+}
+
+// Must count a failed batch write as one abort, requeueing each message
+func TestRequestHandler_Handle_19(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	batch := []*testMessage{
+		{body: []byte("foo"), deliveries: 1},
+		{body: []byte("bar"), deliveries: 1},
+		{body: []byte("baz"), deliveries: 3},
+	}
+	d := make(chan broker.Message, len(batch))
+	for _, message := range batch {
+		d <- message
+	}
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(d, nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	request := &http.Request{Method: "GET"}
+	ctx, cancel := context.WithTimeout(request.Context(), time.Second)
+	defer cancel()
+
+	r := NewServerSentHandler(
+		c,
+		NewPattern("-"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{Prefetch: 3, Redeliver: 2},
+	)
+	r.Handle(&badWriter{}, request.WithContext(ctx))
+
+	for _, message := range batch {
+		if len(message.nacked) != 1 {
+			t.Errorf("expected one nack, got %v", message.nacked)
+		}
+	}
+	stats := r.(*handler).metric.Report().(metric.Stats)
+	if stats.Abort != 1 || stats.Requeue != 2 || stats.DeadLetter != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(t time.Time) error {
+	r.deadlines = append(r.deadlines, t)
+	return nil
+}
+
+// Must clear the write deadline when the stream ends
+func TestRequestHandler_Handle_20(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(make(chan broker.Message), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("-"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{
+			WriteTimeout: time.Second,
+			MaxIdle:      time.Millisecond * 20,
+			Retry:        time.Second,
+		},
+	)
+
+	recorder := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.Handle(recorder, &http.Request{Method: "GET"})
+
+	n := len(recorder.deadlines)
+	if n < 3 || recorder.deadlines[n-2].IsZero() || !recorder.deadlines[n-1].IsZero() {
+		t.Errorf("expected deadlines set and cleared last, got %v", recorder.deadlines)
+	}
+	if !strings.HasSuffix(recorder.Body.String(), "retry: 1000\n\n") {
+		t.Errorf("expected retry hint, got %q", recorder.Body.String())
+	}
+}
+
+// Must evict slow clients awaiting confirmation
+func TestRequestHandler_Handle_21(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	message := &testMessage{id: "1-0", body: []byte("foo")}
+	d := make(chan broker.Message, 1)
+	d <- message
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(d, nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	m := metric.NewMetric("test")
+	h := NewServerSentHandler(
+		c,
+		NewPattern("-"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		m,
+		&StreamOptions{
+			Confirm:        NewConfirmation(),
+			ConfirmTimeout: time.Millisecond,
+			MinThroughput:  1 << 20,
+			SlowPolicy:     SlowDisconnect,
+			Retry:          time.Second,
+		},
+	)
+
+	request := &http.Request{Method: "GET"}
+	ctx, cancel := context.WithTimeout(request.Context(), 5*time.Second)
+	defer cancel()
+
+	w := &slowWriter{ResponseRecorder: httptest.NewRecorder()}
+	h.Handle(w, request.WithContext(ctx))
+
+	if ctx.Err() != nil {
+		t.Fatal("expected stream to be evicted")
+	}
+	if stats := m.Report().(metric.Stats); stats.Evict != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if message.acked != 0 || !strings.HasSuffix(w.Body.String(), "retry: 1000\n\n") {
+		t.Errorf("expected unacked message and retry hint, got %d %q", message.acked, w.Body.String())
+	}
+}
+
+// Must deliver an unconfirmed message again to a client resuming with its
+// Last-Event-ID
+func TestRequestHandler_Handle_22(t *testing.T) {
+	server := miniredis.RunT(t)
+	conn, err := broker.DialRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	id, _ := server.XAdd("q", "*", []string{"data", "foo"})
+	confirm := NewConfirmation()
+
+	stream := func(w http.ResponseWriter, ctx context.Context, lastID string) {
+		consumer := NewConsumer(conn, 1800, 1)
+		defer func() { _ = consumer.Close() }()
+
+		h := NewServerSentHandler(
+			consumer,
+			NewPattern("q"),
+			event.NewProducer(),
+			&ResponseHeader{},
+			metric.NewMetric("test"),
+			&StreamOptions{Confirm: confirm, ConfirmTimeout: time.Minute},
+		)
+		request := (&http.Request{Method: "GET", Header: http.Header{}}).WithContext(ctx)
+		request.Header.Set("Last-Event-ID", lastID)
+		h.Handle(w, request)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	w := &syncRecorder{ResponseRecorder: httptest.NewRecorder()}
+	go func() {
+		for !strings.Contains(w.String(), "data: foo\n") && ctx.Err() == nil {
+			time.Sleep(time.Millisecond * 10)
+		}
+		cancel() // disconnect before the ack
+	}()
+	stream(w, ctx, "")
+	if !strings.Contains(w.String(), "data: foo\n") {
+		t.Fatal("expected delivery")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	recorder := httptest.NewRecorder()
+	stream(recorder, ctx, id)
+
+	if !strings.Contains(recorder.Body.String(), "data: foo\n") {
+		t.Errorf("expected message delivered again, got %q", recorder.Body.String())
+	}
+}
+
+// Must serve concurrent requests with the same handler, each stream with
+// state of its own
+func TestRequestHandler_Handle_23(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), "").DoAndReturn(func(queue, _ string) (<-chan broker.Message, error) {
+		d := make(chan broker.Message, 1)
+		d <- &testMessage{id: queue, body: []byte(queue)}
+		return d, nil
+	}).Times(2)
+	c.EXPECT().Notify(gomock.Any()).Times(2)
+	c.EXPECT().Ignore(gomock.Any()).Times(2)
+
+	m := metric.NewMetric("test")
+	h := NewServerSentHandler(
+		c,
+		NewPattern("${query:id}"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		m,
+		&StreamOptions{Heartbeat: time.Millisecond * 10, MinThroughput: 1},
+	)
+
+	var wg sync.WaitGroup
+	recorders := map[string]*httptest.ResponseRecorder{}
+	for _, id := range []string{"a", "b"} {
+		recorder := httptest.NewRecorder()
+		recorders[id] = recorder
+		request := httptest.NewRequest("GET", "/?id="+id, nil)
+		ctx, cancel := context.WithTimeout(request.Context(), time.Millisecond*100)
+		defer cancel()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Handle(recorder, request.WithContext(ctx))
+		}()
+	}
+	wg.Wait()
+
+	for id, recorder := range recorders {
+		if !strings.Contains(recorder.Body.String(), "id: "+id+"\ndata: "+id+"\n") {
+			t.Errorf("unexpected stream %s: %q", id, recorder.Body.String())
+		}
+	}
+	if stats := m.Report().(metric.Stats); stats.Evict != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// Must send heartbeats while awaiting a confirmation, extending the write
+// deadline
+func TestRequestHandler_Handle_24(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	message := &testMessage{id: "1-0", body: []byte("foo")}
+	d := make(chan broker.Message, 1)
+	d <- message
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return(d, nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("-"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{
+			Confirm:        NewConfirmation(),
+			ConfirmTimeout: time.Minute,
+			Heartbeat:      time.Millisecond * 20,
+			WriteTimeout:   time.Second,
+		},
+	)
+
+	request := &http.Request{Method: "GET"}
+	ctx, cancel := context.WithTimeout(request.Context(), time.Millisecond*150)
+	defer cancel()
+
+	w := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.Handle(w, request.WithContext(ctx))
+
+	body := w.Body.String()
+	if i := strings.Index(body, "data: foo\n"); i < 0 || strings.Count(body[i:], ":\n\n") < 3 {
+		t.Errorf("expected heartbeats after delivery, got %q", body)
+	}
+	if strings.Count(body, "data: foo\n") != 1 || atomic.LoadInt32(&message.acked) != 0 {
+		t.Errorf("expected a single unconfirmed delivery, got %q", body)
+	}
+	// banner, delivery, heartbeats and the cleared deadline
+	if len(w.deadlines) < 6 {
+		t.Errorf("expected the write deadline extended, got %v", w.deadlines)
+	}
+}
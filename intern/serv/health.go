@@ -0,0 +1,104 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+type (
+	// Probe checks a condition of readiness, nil when ready.
+	Probe func() error
+
+	healthHandler struct {
+		probes []Probe
+	}
+
+	// Limiter bounds the number of concurrent streams.
+	Limiter interface {
+		Acquire() bool
+		Release()
+		Full() bool
+	}
+	limiter struct {
+		max  int64
+		open int64
+	}
+)
+
+var (
+	errMaxStreams = errors.New("max streams exceeded")
+	errDraining   = errors.New("draining")
+)
+
+// NewHealthHandler answers 200 when all probes pass, 503 with the reason
+// of the first failed probe otherwise. Without probes it tells the process
+// is alive.
+func NewHealthHandler(probes ...Probe) ResponseHandler {
+	return &healthHandler{probes: probes}
+}
+
+// Handle ...
+func (h *healthHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, probe := range h.probes {
+		if err := probe(); err != nil {
+			w.Header().Set("X-Status-Reason", err.Error())
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprintln(w, err)
+			return
+		}
+	}
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+// DrainProbe fails once drain is closed.
+func DrainProbe(drain <-chan struct{}) Probe {
+	return func() error {
+		select {
+		case <-drain:
+			return errDraining
+		default:
+			return nil
+		}
+	}
+}
+
+// LimitProbe fails while the limiter is full.
+func LimitProbe(l Limiter) Probe {
+	return func() error {
+		if l.Full() {
+			return errMaxStreams
+		}
+		return nil
+	}
+}
+
+// NewLimiter allows up to max concurrent streams, unlimited with zero.
+func NewLimiter(max int) Limiter {
+	return &limiter{max: int64(max)}
+}
+
+// Acquire reserves a stream, false when the limit is reached.
+func (l *limiter) Acquire() bool {
+	if atomic.AddInt64(&l.open, 1) > l.max && l.max > 0 {
+		atomic.AddInt64(&l.open, -1)
+		return false
+	}
+	return true
+}
+
+// Release ...
+func (l *limiter) Release() {
+	atomic.AddInt64(&l.open, -1)
+}
+
+// Full ...
+func (l *limiter) Full() bool {
+	return l.max > 0 && atomic.LoadInt64(&l.open) >= l.max
+}
@@ -0,0 +1,90 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Must answer 200 when all probes pass, 503 with the first failure otherwise
+func TestHealthHandler_Handle(t *testing.T) {
+	pass := func() error { return nil }
+	fail := func() error { return errors.New("failed") }
+	never := func() error { t.Error("expected probe not to run"); return nil }
+
+	samples := []struct {
+		probes []Probe
+		status int
+		body   string
+	}{
+		{probes: nil, status: http.StatusOK, body: "ok\n"},
+		{probes: []Probe{pass, pass}, status: http.StatusOK, body: "ok\n"},
+		{probes: []Probe{pass, fail, never}, status: http.StatusServiceUnavailable, body: "failed\n"},
+	}
+
+	for i, sample := range samples {
+		w := httptest.NewRecorder()
+		NewHealthHandler(sample.probes...).Handle(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		if w.Code != sample.status {
+			t.Errorf("%d: expected status %d, got %d", i, sample.status, w.Code)
+		}
+		if w.Body.String() != sample.body {
+			t.Errorf("%d: expected body %q, got %q", i, sample.body, w.Body.String())
+		}
+		if sample.status != http.StatusOK && w.Header().Get("X-Status-Reason") != "failed" {
+			t.Errorf("%d: expected reason header, got %q", i, w.Header().Get("X-Status-Reason"))
+		}
+	}
+}
+
+// Must fail once draining
+func TestHealthHandler_DrainProbe(t *testing.T) {
+	drain := make(chan struct{})
+	probe := DrainProbe(drain)
+
+	if err := probe(); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	close(drain)
+	if err := probe(); err != errDraining {
+		t.Errorf("expected %v, got %v", errDraining, err)
+	}
+}
+
+// Must bound the number of concurrent streams
+func TestHealthHandler_Limiter(t *testing.T) {
+	l := NewLimiter(2)
+	probe := LimitProbe(l)
+
+	if !l.Acquire() || !l.Acquire() {
+		t.Fatal("expected streams to be acquired")
+	}
+	if l.Acquire() {
+		t.Error("expected limit to be reached")
+	}
+	if err := probe(); err != errMaxStreams {
+		t.Errorf("expected %v, got %v", errMaxStreams, err)
+	}
+
+	l.Release()
+	if err := probe(); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+	if !l.Acquire() {
+		t.Error("expected stream to be acquired")
+	}
+
+	unlimited := NewLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.Acquire() {
+			t.Fatal("expected unlimited streams")
+		}
+	}
+	if unlimited.Full() {
+		t.Error("expected not full")
+	}
+}
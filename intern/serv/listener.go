@@ -0,0 +1,66 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// envListenFD passes the listening socket to a restarted process.
+	envListenFD = "EVENTSOURCED_LISTEN_FD"
+	// sdListenFDsStart is the first descriptor passed by systemd.
+	sdListenFDsStart = 3
+)
+
+var errNoFile = errors.New("server: listener has no file descriptor")
+
+// listen takes over a listening socket passed by a parent process or by
+// systemd socket activation, else it listens on the TCP address.
+func listen(addr string) (net.Listener, bool, error) {
+	fd, ok := inheritedFD()
+	if !ok {
+		l, err := net.Listen("tcp", addr)
+		return l, false, err
+	}
+
+	// Not to be passed on to processes started by us.
+	_ = os.Unsetenv(envListenFD)
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(fd, "listener")
+	defer func() { _ = f.Close() }()
+
+	l, err := net.FileListener(f)
+	return l, true, err
+}
+
+// inheritedFD returns the descriptor of an inherited listening socket.
+// Only the first one is used when systemd passes several.
+func inheritedFD() (uintptr, bool) {
+	if fd, err := strconv.Atoi(os.Getenv(envListenFD)); err == nil && fd > 2 {
+		return uintptr(fd), true
+	}
+
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+	if pid == os.Getpid() && fds > 0 {
+		return sdListenFDsStart, true
+	}
+	return 0, false
+}
+
+// listenerFile returns a duplicate of the socket descriptor of l.
+func listenerFile(l net.Listener) (*os.File, error) {
+	filer, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errNoFile
+	}
+	return filer.File()
+}
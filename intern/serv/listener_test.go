@@ -0,0 +1,65 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// Must take over the listening socket passed by the parent process
+func TestListen_Inherited(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = parent.Close() }()
+
+	f, err := listenerFile(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	t.Setenv(envListenFD, strconv.Itoa(int(f.Fd())))
+
+	l, inherited, err := listen("127.0.0.1:1")
+	if err != nil || !inherited {
+		t.Fatalf("expected inherited listener, got %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	if l.Addr().String() != parent.Addr().String() {
+		t.Errorf("expected %s, got %s", parent.Addr(), l.Addr())
+	}
+	if os.Getenv(envListenFD) != "" {
+		t.Error("expected environment to be cleared")
+	}
+}
+
+// Must detect systemd socket activation for this process only
+func TestListen_Systemd(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+
+	if _, ok := inheritedFD(); ok {
+		t.Error("unexpected socket of foreign process")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	if fd, ok := inheritedFD(); !ok || fd != sdListenFDsStart {
+		t.Errorf("expected descriptor %d, got %d", sdListenFDsStart, fd)
+	}
+}
+
+// Must listen on the address when nothing is inherited
+func TestListen_Address(t *testing.T) {
+	l, inherited, err := listen("127.0.0.1:0")
+	if err != nil || inherited {
+		t.Fatalf("expected new listener, got %v", err)
+	}
+	_ = l.Close()
+}
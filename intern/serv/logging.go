@@ -0,0 +1,55 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"eventsourced/intern/broker"
+)
+
+const headerRequestID = "X-Request-ID"
+
+var requestIDRegEx = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+
+// requestID takes the id of the request from the X-Request-ID header, or
+// generates one, and hands it back to the client.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(headerRequestID)
+	if !requestIDRegEx.MatchString(id) {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(headerRequestID, id)
+	return id
+}
+
+// logger returns the logger of the options, falls back to the default one.
+func (h *handler) logger() *slog.Logger {
+	if h.options != nil && h.options.Logger != nil {
+		return h.options.Logger
+	}
+	return slog.Default()
+}
+
+// logDelivery counts the delivered messages of the stream and logs every
+// n-th of them as set by LogMessages.
+func (s *stream) logDelivery(message broker.Message) {
+	s.delivered++
+	if s.session != nil {
+		s.session.Delivered()
+	}
+
+	if n := s.options.LogMessages; n > 0 && s.delivered%n == 0 {
+		s.log.Info("stream: delivered",
+			"message_id", message.ID(),
+			"deliveries", message.Deliveries(),
+			"bytes", len(message.Body()),
+		)
+	}
+}
@@ -0,0 +1,44 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"time"
+)
+
+type (
+	// meter measures the throughput of a stream while blocked in writes,
+	// so idle streams and fast clients do not count as slow.
+	meter struct {
+		floor int
+		bytes int
+		busy  time.Duration
+	}
+)
+
+const meterWindow = time.Second
+
+func newMeter(floor int) *meter {
+	if floor <= 0 {
+		return nil
+	}
+	return &meter{floor: floor}
+}
+
+// record adds n bytes written in d and reports whether the throughput fell
+// below the floor, once writes blocked for a full window.
+func (m *meter) record(n int, d time.Duration) bool {
+	if m == nil {
+		return false
+	}
+	m.bytes += n
+	m.busy += d
+
+	if m.busy < meterWindow {
+		return false
+	}
+	rate := float64(m.bytes) / m.busy.Seconds()
+	m.bytes, m.busy = 0, 0
+
+	return rate < float64(m.floor)
+}
@@ -0,0 +1,35 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"testing"
+	"time"
+)
+
+// Must report slow throughput once a full window was spent writing
+func TestMeter_Record(t *testing.T) {
+	m := newMeter(1000)
+
+	if m.record(100, time.Millisecond*500) {
+		t.Error("unexpected report before full window")
+	}
+	if !m.record(100, time.Millisecond*500) {
+		t.Error("expected slow throughput")
+	}
+	if m.record(5000, time.Second*2) {
+		t.Error("unexpected slow throughput")
+	}
+	if m.record(1, time.Millisecond) {
+		t.Error("expected window to be reset")
+	}
+}
+
+// Must not measure without floor
+func TestMeter_Disabled(t *testing.T) {
+	m := newMeter(0)
+
+	if m != nil || m.record(0, time.Hour) {
+		t.Error("expected disabled meter")
+	}
+}
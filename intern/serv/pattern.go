@@ -55,14 +55,49 @@ func (p *pattern) Apply(r *http.Request) (string, error) {
 	if queue = p.keyVal.ReplaceAllStringFunc(p.pattern, repl); err != nil {
 		return queue, err
 	}
+
+	return queue, validQueue(queue)
+}
+
+// ValidatePattern checks the tuples of a pattern and the queue names it
+// yields.
+func ValidatePattern(s string) error {
+	if err := validTemplate(s, "cookie", "query"); err != nil {
+		return err
+	}
+	return validQueue(tupleRegEx.ReplaceAllString(wsReplacer.Replace(s), "x"))
+}
+
+// validTemplate rejects tuples of categories other than the given ones,
+// and tuples not terminated.
+func validTemplate(s string, categories ...string) error {
+	s = wsReplacer.Replace(s)
+
+	for _, m := range tupleRegEx.FindAllStringSubmatch(s, -1) {
+		known := false
+		for _, cat := range categories {
+			known = known || m[1] == cat
+		}
+		if !known {
+			return fmt.Errorf("unknown category %q in %s", m[1], m[0])
+		}
+	}
+	if i := strings.Index(tupleRegEx.ReplaceAllString(s, ""), "${"); i >= 0 {
+		return fmt.Errorf("unterminated tuple in %q", s)
+	}
+	return nil
+}
+
+// validQueue rejects names reserved by AMQP brokers and names exceeding
+// the length limit.
+func validQueue(queue string) error {
 	if strings.HasPrefix(strings.ToLower(queue), "amq.") {
-		return queue, errQueueName
+		return errQueueName
 	}
 	if len(queue) == 0 || len(queue) > 255 {
-		return queue, errQueueName
+		return errQueueName
 	}
-
-	return queue, err
+	return nil
 }
 
 func resolve(r *http.Request, cat string, key string) (string, error) {
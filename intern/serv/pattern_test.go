@@ -164,3 +164,28 @@ func TestPattern_QueueName(t *testing.T) {
 	}
 
 }
+
+// Must reject unknown categories, unterminated tuples and reserved names
+func TestPattern_Validate(t *testing.T) {
+	for pattern, valid := range map[string]bool{
+		"${query:id}":            true,
+		"user.${cookie:sid}":     true,
+		"${header:id}":           false,
+		"${query:id":             false,
+		"amq.${query:id}":        false,
+		"":                       false,
+		"static":                 true,
+		"${query:a}.${cookie:b}": true,
+	} {
+		if err := ValidatePattern(pattern); (err == nil) != valid {
+			t.Errorf("pattern %q: unexpected error %v", pattern, err)
+		}
+	}
+
+	if err := (Claims{"sub": "${header:X-User}", "tenant": "${query:t}"}).Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := (Claims{"sub": "${body:user}"}).Validate(); err == nil || !strings.HasPrefix(err.Error(), "sub: ") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
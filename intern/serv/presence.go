@@ -0,0 +1,224 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"eventsourced/intern/broker"
+)
+
+type (
+	// Presence publishes the lifecycle of streams.
+	Presence interface {
+		Connected(e PresenceEvent)
+		Disconnected(e PresenceEvent)
+		Close() error
+	}
+	presence struct {
+		brConn   <-chan broker.Connection
+		exchange string
+		instance string
+		logger   *slog.Logger
+		events   chan PresenceEvent
+		done     chan struct{}
+		stopped  chan struct{}
+	}
+
+	// PresenceEvent is published as JSON with its type as routing key.
+	PresenceEvent struct {
+		Type         string            `json:"type"`
+		Queue        string            `json:"queue"`
+		Claims       map[string]string `json:"claims,omitempty"`
+		Instance     string            `json:"instance"`
+		RequestID    string            `json:"request_id"`
+		RemoteAddr   string            `json:"remote_addr"`
+		Node         string            `json:"node"`
+		Connected    time.Time         `json:"connected"`
+		Disconnected *time.Time        `json:"disconnected,omitempty"`
+		Reason       string            `json:"reason,omitempty"`
+		Delivered    int               `json:"delivered,omitempty"`
+	}
+
+	// Claims maps claim names to templates of ${cookie:name}, ${query:name}
+	// or ${header:name} tuples, resolved from the request of a stream.
+	Claims map[string]string
+)
+
+var errNoPublisher = errors.New("publishing not supported by broker")
+
+const (
+	presenceConnected    = "connected"
+	presenceDisconnected = "disconnected"
+
+	// presenceBuffer bounds the events waiting for a broker connection,
+	// further events are dropped.
+	presenceBuffer = 1024
+	// presenceTimeout bounds the wait for a broker connection, and for
+	// the pending events on Close.
+	presenceTimeout = 5 * time.Second
+)
+
+// Reasons a stream ended for, aborted unless known.
+const (
+	reasonAborted = "aborted"
+	reasonClient  = "client"
+	reasonBroker  = "broker"
+	reasonWrite   = "write"
+	reasonEvicted = "evicted"
+	reasonIdle    = "idle"
+	reasonDrain   = "drain"
+	reasonClosed  = "closed"
+)
+
+// NewPresence publishes the events to the exchange through the broker
+// connections, tagged by instance. Events are published in order by a
+// goroutine of its own, so streams do not wait for the broker.
+func NewPresence(brConn <-chan broker.Connection, exchange, instance string, logger *slog.Logger) Presence {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	p := &presence{
+		brConn:   brConn,
+		exchange: exchange,
+		instance: instance,
+		logger:   logger,
+		events:   make(chan PresenceEvent, presenceBuffer),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Connected ...
+func (p *presence) Connected(e PresenceEvent) {
+	e.Type = presenceConnected
+	p.enqueue(e)
+}
+
+// Disconnected sets the time of disconnection unless given.
+func (p *presence) Disconnected(e PresenceEvent) {
+	e.Type = presenceDisconnected
+	if e.Disconnected == nil {
+		now := time.Now()
+		e.Disconnected = &now
+	}
+	p.enqueue(e)
+}
+
+// Close publishes the pending events, waiting up to the timeout.
+func (p *presence) Close() error {
+	close(p.done)
+
+	select {
+	case <-p.stopped:
+	case <-time.After(presenceTimeout):
+	}
+	return nil
+}
+
+func (p *presence) enqueue(e PresenceEvent) {
+	e.Instance = p.instance
+
+	select {
+	case p.events <- e:
+	default:
+		p.logger.Warn("presence: event dropped", "type", e.Type, "queue", e.Queue)
+	}
+}
+
+func (p *presence) run() {
+	defer close(p.stopped)
+
+	for {
+		select {
+		case e := <-p.events:
+			p.publish(e)
+		case <-p.done:
+			for {
+				select {
+				case e := <-p.events:
+					p.publish(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// publish tries twice, on another connection again.
+func (p *presence) publish(e PresenceEvent) {
+	body, _ := json.Marshal(e)
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if err = p.send(e.Type, body); err == nil {
+			return
+		}
+	}
+	p.logger.Warn("presence: publish failed", "type", e.Type, "queue", e.Queue, "error", err)
+}
+
+func (p *presence) send(key string, body []byte) error {
+	timeout := time.NewTimer(presenceTimeout)
+	defer timeout.Stop()
+
+	select {
+	case conn := <-p.brConn:
+		if pub, ok := broker.Unwrap(conn).(broker.Publisher); ok {
+			return pub.Publish(p.exchange, key, body)
+		}
+		return errNoPublisher
+	case <-timeout.C:
+		return errNoConnection
+	}
+}
+
+// Apply resolves the claims from the request, values not present are
+// left empty. Returns nil without claims.
+func (c Claims) Apply(r *http.Request) map[string]string {
+	if len(c) == 0 {
+		return nil
+	}
+	claims := make(map[string]string, len(c))
+
+	for name, template := range c {
+		claims[name] = tupleRegEx.ReplaceAllStringFunc(wsReplacer.Replace(template), func(m string) string {
+			var cat, key string
+
+			s := tupleRegEx.ReplaceAllString(m, "$1 $2")
+			_, _ = fmt.Sscanf(s, "%s %s", &cat, &key)
+
+			if cat == "header" {
+				return r.Header.Get(key)
+			}
+			val, _ := resolve(r, cat, key)
+			return val
+		})
+	}
+	return claims
+}
+
+// Validate checks the templates of the claims.
+func (c Claims) Validate() error {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := validTemplate(c[name], "cookie", "query", "header"); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"eventsourced/intern/broker"
+	"eventsourced/intern/event"
+	"eventsourced/intern/metric"
+	"eventsourced/intern/mock/serv"
+
+	"github.com/golang/mock/gomock"
+)
+
+// Must resolve claims from cookies, query and header
+func TestClaims_Apply(t *testing.T) {
+	r := &http.Request{
+		URL:    &url.URL{RawQuery: "tenant=a"},
+		Header: http.Header{"X-User": []string{"1"}, "Cookie": []string{"sid=s"}},
+	}
+	claims := Claims{
+		"user":    "${header:X-User}",
+		"tenant":  "tenant-${query:tenant}",
+		"session": "${cookie:sid}",
+		"missing": "${query:missing}",
+	}.Apply(r)
+
+	expect := map[string]string{"user": "1", "tenant": "tenant-a", "session": "s", "missing": ""}
+	for k, v := range expect {
+		if claims[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, claims[k])
+		}
+	}
+	if Claims(nil).Apply(r) != nil {
+		t.Error("expected nil without claims")
+	}
+}
+
+// Must publish connected and disconnected events of a stream in order
+func TestPresence(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	conn, _ := broker.DialMemory("memory://test-presence")
+	_ = broker.OpenMemory("test-presence").Declare("presence", 0)
+
+	brConn := make(chan broker.Connection)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case brConn <- conn:
+			case <-done:
+				return
+			}
+		}
+	}()
+	presence := NewPresence(brConn, "presence", "i-1", slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+
+	messages := make(chan broker.Message, 1)
+	messages <- &testMessage{id: "1", body: []byte("foo")}
+	close(messages)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume(gomock.Any(), gomock.Any()).Return((<-chan broker.Message)(messages), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	h := NewServerSentHandler(
+		c,
+		NewPattern("q"),
+		event.NewProducer(),
+		&ResponseHeader{},
+		metric.NewMetric("test"),
+		&StreamOptions{
+			Node:     "n0:5672",
+			Presence: presence,
+			Claims:   Claims{"user": "${header:X-User}"},
+			Logger:   slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+		},
+	)
+	r := &http.Request{Method: "GET", Header: http.Header{"X-User": []string{"1"}}}
+	h.Handle(&syncRecorder{ResponseRecorder: httptest.NewRecorder()}, r)
+	_ = presence.Close()
+
+	sub, _ := conn.Subscribe("presence", broker.Options{Prefetch: 2})
+	defer func() { _ = sub.Close() }()
+
+	var events []PresenceEvent
+	for len(events) < 2 {
+		select {
+		case msg := <-sub.Messages():
+			var e PresenceEvent
+			if err := json.Unmarshal(msg.Body(), &e); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, e)
+		case <-time.After(time.Second):
+			t.Fatalf("expected events, got %v", events)
+		}
+	}
+
+	for i, typ := range []string{"connected", "disconnected"} {
+		e := events[i]
+		if e.Type != typ || e.Queue != "q" || e.Instance != "i-1" || e.Node != "n0:5672" || e.Claims["user"] != "1" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+	if e := events[1]; e.Reason != reasonBroker || e.Delivered != 1 || e.Disconnected == nil || e.Disconnected.Before(e.Connected) {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
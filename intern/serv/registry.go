@@ -0,0 +1,183 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"eventsourced/intern/event"
+)
+
+type (
+	// Registry tracks the open streams, which may be closed from outside.
+	Registry interface {
+		Register(info StreamInfo) Session
+		Streams() []StreamInfo
+		Stream(id string) (StreamInfo, bool)
+		Close(id string, final event.ServerSentEvent) bool
+		CloseQueue(queue string, final event.ServerSentEvent) int
+	}
+	registry struct {
+		mu       sync.Mutex
+		sessions map[string]*session
+	}
+
+	// Session is the registration of an open stream.
+	Session interface {
+		ID() string
+		Done() <-chan struct{}
+		Final() event.ServerSentEvent
+		Delivered()
+		Unregister()
+	}
+	session struct {
+		info      StreamInfo
+		delivered int64
+		registry  *registry
+		done      chan struct{}
+		final     event.ServerSentEvent
+		once      sync.Once
+	}
+
+	// StreamInfo describes an open stream.
+	StreamInfo struct {
+		ID         string    `json:"id"`
+		RequestID  string    `json:"request_id"`
+		Queue      string    `json:"queue"`
+		RemoteAddr string    `json:"remote_addr"`
+		Node       string    `json:"node"`
+		Group      string    `json:"group,omitempty"`
+		Started    time.Time `json:"started"`
+		Delivered  int64     `json:"delivered"`
+	}
+)
+
+// NewRegistry ...
+func NewRegistry() Registry {
+	return &registry{sessions: map[string]*session{}}
+}
+
+// Register adds a stream under a new id, the start time is set when zero.
+func (r *registry) Register(info StreamInfo) Session {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	info.ID = hex.EncodeToString(b)
+	if info.Started.IsZero() {
+		info.Started = time.Now()
+	}
+	s := &session{info: info, registry: r, done: make(chan struct{})}
+
+	r.mu.Lock()
+	r.sessions[info.ID] = s
+	r.mu.Unlock()
+
+	return s
+}
+
+// Streams lists the open streams, oldest first.
+func (r *registry) Streams() []StreamInfo {
+	r.mu.Lock()
+	streams := make([]StreamInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		streams = append(streams, s.stat())
+	}
+	r.mu.Unlock()
+
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].Started.Before(streams[j].Started)
+	})
+	return streams
+}
+
+// Stream ...
+func (r *registry) Stream(id string) (StreamInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.sessions[id]; ok {
+		return s.stat(), true
+	}
+	return StreamInfo{}, false
+}
+
+// Close ends the stream of the given id, the final event is sent before
+// when not nil.
+func (r *registry) Close(id string, final event.ServerSentEvent) bool {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	r.mu.Unlock()
+
+	if ok {
+		s.close(final)
+	}
+	return ok
+}
+
+// CloseQueue ends all streams of the queue, returns their number.
+func (r *registry) CloseQueue(queue string, final event.ServerSentEvent) int {
+	var closing []*session
+
+	r.mu.Lock()
+	for _, s := range r.sessions {
+		if s.info.Queue == queue {
+			closing = append(closing, s)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, s := range closing {
+		s.close(final)
+	}
+	return len(closing)
+}
+
+// ID ...
+func (s *session) ID() string {
+	return s.info.ID
+}
+
+// Done is closed when the stream is to be closed.
+func (s *session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Final returns the event to send before closing, nil for none.
+func (s *session) Final() event.ServerSentEvent {
+	select {
+	case <-s.done:
+		return s.final
+	default:
+		return nil
+	}
+}
+
+// Delivered counts a message delivered.
+func (s *session) Delivered() {
+	atomic.AddInt64(&s.delivered, 1)
+}
+
+// Unregister ...
+func (s *session) Unregister() {
+	s.registry.mu.Lock()
+	delete(s.registry.sessions, s.info.ID)
+	s.registry.mu.Unlock()
+}
+
+func (s *session) close(final event.ServerSentEvent) {
+	s.once.Do(func() {
+		s.final = final
+		close(s.done)
+	})
+}
+
+func (s *session) stat() StreamInfo {
+	info := s.info
+	info.Delivered = atomic.LoadInt64(&s.delivered)
+	return info
+}
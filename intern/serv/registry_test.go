@@ -0,0 +1,60 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"testing"
+	"time"
+
+	"eventsourced/intern/event"
+)
+
+// Must list, describe and close registered streams
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	a := r.Register(StreamInfo{Queue: "a", Started: time.Now().Add(-time.Second)})
+	b := r.Register(StreamInfo{Queue: "b"})
+	c := r.Register(StreamInfo{Queue: "b"})
+
+	if a.ID() == "" || a.ID() == b.ID() {
+		t.Errorf("expected distinct ids, got %q and %q", a.ID(), b.ID())
+	}
+
+	a.Delivered()
+	a.Delivered()
+
+	streams := r.Streams()
+	if len(streams) != 3 || streams[0].ID != a.ID() || streams[0].Delivered != 2 {
+		t.Errorf("unexpected streams %v", streams)
+	}
+	if s, ok := r.Stream(b.ID()); !ok || s.Queue != "b" || s.Started.IsZero() {
+		t.Errorf("unexpected stream %v", s)
+	}
+
+	final := event.NewProducer().NamedEvent("closed", nil)
+	if a.Final() != nil {
+		t.Error("expected no final event while open")
+	}
+	if !r.Close(a.ID(), final) {
+		t.Error("expected stream to be closed")
+	}
+	if _, ok := <-a.Done(); ok || a.Final() != final {
+		t.Error("expected closed stream with final event")
+	}
+	if r.Close("unknown", nil) {
+		t.Error("expected unknown stream")
+	}
+
+	if n := r.CloseQueue("b", nil); n != 2 {
+		t.Errorf("expected 2 streams closed, got %d", n)
+	}
+	if _, ok := <-c.Done(); ok || c.Final() != nil {
+		t.Error("expected closed stream without final event")
+	}
+
+	a.Unregister()
+	if _, ok := r.Stream(a.ID()); ok || len(r.Streams()) != 2 {
+		t.Errorf("unexpected streams %v", r.Streams())
+	}
+}
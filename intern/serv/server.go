@@ -4,7 +4,9 @@ package serv
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -20,59 +22,160 @@ type (
 	}
 	server struct {
 		server *http.Server
+		drain  time.Duration
+		logger *slog.Logger
+	}
+	adminServer struct {
+		server *http.Server
+		logger *slog.Logger
 	}
 )
 
 const (
-	logServerListen = "server: listening %s"
-	logServerClosed = "server: closed %s"
-	logServerSignal = "server: caught signal: %s (%#v)"
-	logServerError  = "server: %s"
+	logServerListen  = "server: listening"
+	logServerRestart = "server: restarted"
+	logServerClosed  = "server: closed"
+	logServerSignal  = "server: caught signal"
+	logServerError   = "server: failed"
+
+	logAdminListen = "admin: listening"
+	logAdminClosed = "admin: closed"
+	logAdminError  = "admin: failed"
 )
 
-// NewServer ...
-func NewServer(srv *http.Server) Server {
-	return &server{srv}
+// adminListenRetry is the time a restarted process waits for the old one
+// to release the admin address.
+const adminListenRetry = 10 * time.Second
+
+// NewServer creates a server, which waits up to the drain period for open
+// streams to end on shutdown. Streams are notified through the shutdown
+// hooks registered with srv. Without logger the default one is used.
+func NewServer(srv *http.Server, drain time.Duration, logger *slog.Logger) Server {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &server{server: srv, drain: drain, logger: logger}
 }
 
-// Launch ...
+// Launch serves on the inherited listening socket or on the configured
+// address. On SIGUSR2 the socket is handed over to a new process of the
+// current executable, which accepts connections while this one drains.
 func (s *server) Launch() error {
 	served := make(chan error)
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	defer signal.Stop(sig)
+
+	l, inherited, err := listen(s.server.Addr)
+	if err != nil {
+		s.logger.Error(logServerError, "error", err)
+		return err
+	}
+	s.logger.Info(logServerListen, "address", l.Addr().String(), "inherited", inherited)
+	go func() { served <- s.server.Serve(l) }()
+
+	for {
+		select {
+		case err := <-served:
+			if err == http.ErrServerClosed {
+				s.logger.Info(logServerClosed, "address", s.server.Addr)
+				return nil
+			}
+			s.logger.Error(logServerError, "error", err)
+			return err
 
-	log.Printf(logServerListen, s.server.Addr)
-	go func() { served <- s.server.ListenAndServe() }()
+		case catch := <-sig:
+			s.logger.Info(logServerSignal, "signal", catch.String())
 
-	select {
-	case err := <-served:
-		if err == http.ErrServerClosed {
-			log.Printf(logServerClosed, s.server.Addr)
-			return nil
+			if catch == syscall.SIGUSR2 {
+				if err := s.restart(l); err != nil {
+					s.logger.Error(logServerError, "error", err)
+					continue
+				}
+			}
+			signal.Stop(sig)
+			return s.Shutdown()
 		}
-		log.Printf(logServerError, err)
+	}
+}
+
+// restart starts the current executable with the same arguments, passing
+// the listening socket as descriptor 3.
+func (s *server) restart(l net.Listener) error {
+	f, err := listenerFile(l)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	exe, err := os.Executable()
+	if err != nil {
 		return err
+	}
 
-	case catch := <-sig:
-		signal.Stop(sig)
-		log.Printf(logServerSignal, catch, catch)
-		return s.Shutdown()
+	env := append(os.Environ(), envListenFD+"=3")
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, f},
+	})
+	if err != nil {
+		return err
 	}
+
+	s.logger.Info(logServerRestart, "pid", p.Pid)
+	return p.Release()
 }
 
-// Shutdown ...
+// Shutdown stops accepting connections and waits for open streams to end,
+// connections still open after the drain period are closed.
 func (s *server) Shutdown() error {
-	emptyCtx := context.Background()
-	duration := time.Second * 2
-
-	ctx, cancel := context.WithTimeout(emptyCtx, duration)
+	ctx, cancel := context.WithTimeout(context.Background(), s.drain)
 	defer cancel()
 
 	if err := s.server.Shutdown(ctx); err != nil {
-		log.Printf(logServerError, err)
-		cancel()
+		s.logger.Error(logServerError, "error", err)
+		return s.server.Close()
 	}
-	<-ctx.Done()
 	return nil
 }
+
+// NewAdminServer creates a server on its own address, which does not take
+// part in restarts or signal handling, it is shut down by the caller.
+func NewAdminServer(srv *http.Server, logger *slog.Logger) Server {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &adminServer{server: srv, logger: logger}
+}
+
+// Launch serves until shut down. The address is retried for a while when
+// in use, it is held by the old process during a restart.
+func (s *adminServer) Launch() error {
+	var l net.Listener
+	var err error
+
+	for deadline := time.Now().Add(adminListenRetry); ; {
+		if l, err = net.Listen("tcp", s.server.Addr); err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) || time.Now().After(deadline) {
+			s.logger.Error(logAdminError, "error", err)
+			return err
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	s.logger.Info(logAdminListen, "address", l.Addr().String())
+
+	if err = s.server.Serve(l); err != http.ErrServerClosed {
+		s.logger.Error(logAdminError, "error", err)
+		return err
+	}
+	s.logger.Info(logAdminClosed, "address", s.server.Addr)
+	return nil
+}
+
+// Shutdown closes the admin server and its connections immediately.
+func (s *adminServer) Shutdown() error {
+	return s.server.Close()
+}
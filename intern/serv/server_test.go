@@ -16,7 +16,7 @@ func TestServer_Launch_1(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	defer func() { log.SetOutput(os.Stderr) }()
 
-	server := NewServer(&http.Server{Addr: ":65535"})
+	server := NewServer(&http.Server{Addr: ":65535"}, time.Second, nil)
 
 	go func() {
 		time.Sleep(time.Second)
@@ -26,3 +26,37 @@ func TestServer_Launch_1(t *testing.T) {
 		t.Error("unexpected error")
 	}
 }
+
+// Must notify streams and end shutdown once they are drained
+func TestServer_Shutdown(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer func() { log.SetOutput(os.Stderr) }()
+
+	drain := make(chan struct{})
+	streaming := make(chan struct{})
+
+	srv := &http.Server{
+		Addr: "127.0.0.1:65534",
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.(http.Flusher).Flush()
+			close(streaming)
+			<-drain
+		}),
+	}
+	srv.RegisterOnShutdown(func() { close(drain) })
+	server := NewServer(srv, time.Second*5, nil)
+
+	go func() { _ = server.Launch() }()
+	time.Sleep(time.Millisecond * 100)
+
+	go func() { _, _ = http.Get("http://127.0.0.1:65534/") }()
+	<-streaming
+
+	start := time.Now()
+	if err := server.Shutdown(); err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected shutdown after drain, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,99 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"eventsourced/intern/broker"
+)
+
+// messageCarrier reads the W3C trace context from the message headers.
+type messageCarrier struct {
+	message broker.Message
+}
+
+var (
+	propagator = propagation.TraceContext{}
+	noopTracer = noop.NewTracerProvider().Tracer("")
+)
+
+func (c messageCarrier) Get(key string) string {
+	if h, ok := c.message.(broker.HeaderReader); ok {
+		return h.Header(key)
+	}
+	return ""
+}
+
+func (c messageCarrier) Set(string, string) {}
+func (c messageCarrier) Keys() []string     { return nil }
+
+func (h *handler) tracer() trace.Tracer {
+	if h.options.Tracer == nil {
+		return noopTracer
+	}
+	return h.options.Tracer
+}
+
+// startStream starts the span of the stream, continuing the trace of the
+// request when a traceparent header is given.
+func (s *stream) startStream(r *http.Request) trace.Span {
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := s.tracer().Start(ctx, "stream",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("client.address", r.RemoteAddr)),
+	)
+	s.ctx = ctx
+	return span
+}
+
+// startSpan starts a span within the stream.
+func (s *stream) startSpan(name string) trace.Span {
+	_, span := s.tracer().Start(s.ctx, name)
+	return span
+}
+
+// startDelivery starts the span of a delivery. It continues the trace of
+// the publisher carried by the message and links the stream, without it
+// is part of the stream trace.
+func (s *stream) startDelivery(message broker.Message) trace.Span {
+	parent := trace.SpanContextFromContext(s.ctx)
+	ctx := propagator.Extract(s.ctx, messageCarrier{message})
+
+	options := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", s.queue),
+			attribute.Int("eventsourced.deliveries", message.Deliveries()),
+		),
+	}
+	if id := message.ID(); id != "" {
+		options = append(options, trace.WithAttributes(attribute.String("messaging.message.id", id)))
+	}
+	if !trace.SpanContextFromContext(ctx).Equal(parent) {
+		options = append(options, trace.WithLinks(trace.Link{SpanContext: parent}))
+	}
+
+	_, span := s.tracer().Start(ctx, "deliver", options...)
+	return span
+}
+
+// endSpan ends a span, marking it failed on error.
+func endSpan(span trace.Span, err error) {
+	traceError(span, err)
+	span.End()
+}
+
+// traceError marks a span failed, unless err is nil.
+func traceError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
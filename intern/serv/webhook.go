@@ -0,0 +1,254 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type (
+	// Webhook calls HTTP endpoints around the lifecycle of streams.
+	// Authorize returns the queue to consume, a DeniedError when the
+	// stream is not allowed.
+	Webhook interface {
+		Authorize(ctx context.Context, e PresenceEvent) (string, error)
+		Closed(e PresenceEvent)
+		Close() error
+	}
+	webhook struct {
+		options WebhookOptions
+		client  *http.Client
+		events  chan PresenceEvent
+		done    chan struct{}
+		stopped chan struct{}
+	}
+
+	// WebhookOptions ...
+	WebhookOptions struct {
+		// Authorize and Closed are the URLs called before a stream opens
+		// and after it closed, either may be empty.
+		Authorize string
+		Closed    string
+		// Secret signs the payloads with HMAC-SHA256.
+		Secret string
+		// Timeout bounds each attempt, Retries is the number of attempts
+		// repeated after failures.
+		Timeout time.Duration
+		Retries int
+		// Instance is set as instance of the events.
+		Instance string
+		Logger   *slog.Logger
+	}
+
+	// DeniedError tells a stream was denied by the authorize webhook.
+	DeniedError struct {
+		Reason string
+	}
+
+	// authorization is the answer of the authorize webhook.
+	authorization struct {
+		Allow  bool   `json:"allow"`
+		Queue  string `json:"queue"`
+		Reason string `json:"reason"`
+	}
+)
+
+const (
+	headerSignature = "X-Eventsourced-Signature"
+	headerTimestamp = "X-Eventsourced-Timestamp"
+
+	webhookAuthorize = "authorize"
+	webhookBackoff   = 100 * time.Millisecond
+	webhookBuffer    = 1024
+)
+
+// NewWebhook ...
+func NewWebhook(options WebhookOptions) Webhook {
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+	w := &webhook{
+		options: options,
+		client:  &http.Client{Timeout: options.Timeout},
+		events:  make(chan PresenceEvent, webhookBuffer),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Error ...
+func (e *DeniedError) Error() string {
+	if e.Reason == "" {
+		return "denied"
+	}
+	return "denied: " + e.Reason
+}
+
+// Authorize asks the authorize webhook whether the stream may open. The
+// answer may override the queue. Without webhook every stream is allowed,
+// with a failing one none, so streams are not opened unchecked.
+func (w *webhook) Authorize(ctx context.Context, e PresenceEvent) (string, error) {
+	if w.options.Authorize == "" {
+		return e.Queue, nil
+	}
+	e.Type, e.Instance = webhookAuthorize, w.options.Instance
+	body, _ := json.Marshal(e)
+
+	res, err := w.call(ctx, w.options.Authorize, body)
+	if err != nil {
+		return "", err
+	}
+
+	// An empty answer allows, a JSON answer must allow explicitly.
+	answer := authorization{Allow: true}
+	if len(bytes.TrimSpace(res)) > 0 {
+		answer = authorization{}
+		if err = json.Unmarshal(res, &answer); err != nil {
+			return "", fmt.Errorf("webhook: invalid answer, %w", err)
+		}
+	}
+	if !answer.Allow {
+		return "", &DeniedError{Reason: answer.Reason}
+	}
+	if answer.Queue == "" {
+		return e.Queue, nil
+	}
+	if err = validQueue(answer.Queue); err != nil {
+		return "", err
+	}
+	return answer.Queue, nil
+}
+
+// Closed calls the closed webhook in the background, in order of the
+// streams closed.
+func (w *webhook) Closed(e PresenceEvent) {
+	if w.options.Closed == "" {
+		return
+	}
+	e.Type, e.Instance = presenceDisconnected, w.options.Instance
+	if e.Disconnected == nil {
+		now := time.Now()
+		e.Disconnected = &now
+	}
+
+	select {
+	case w.events <- e:
+	default:
+		w.options.Logger.Warn("webhook: event dropped", "queue", e.Queue)
+	}
+}
+
+// Close calls the webhook for the pending events, waiting up to the
+// timeout of a call.
+func (w *webhook) Close() error {
+	close(w.done)
+
+	select {
+	case <-w.stopped:
+	case <-time.After(w.options.Timeout + webhookBackoff):
+	}
+	return nil
+}
+
+func (w *webhook) run() {
+	defer close(w.stopped)
+
+	for {
+		select {
+		case e := <-w.events:
+			w.closed(e)
+		case <-w.done:
+			for {
+				select {
+				case e := <-w.events:
+					w.closed(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *webhook) closed(e PresenceEvent) {
+	body, _ := json.Marshal(e)
+
+	if _, err := w.call(context.Background(), w.options.Closed, body); err != nil {
+		w.options.Logger.Warn("webhook: call failed", "url", w.options.Closed, "queue", e.Queue, "error", err)
+	}
+}
+
+// call posts the signed body, repeated with backoff on server errors and
+// failed connections. Client errors are final, 401 and 403 deny.
+func (w *webhook) call(ctx context.Context, url string, body []byte) ([]byte, error) {
+	var err error
+
+	for attempt := 0; attempt <= w.options.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(webhookBackoff << (attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		var res *http.Response
+		if res, err = w.post(ctx, url, body); err != nil {
+			continue
+		}
+		answer, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+		_ = res.Body.Close()
+
+		switch {
+		case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+			return nil, &DeniedError{Reason: res.Header.Get("X-Status-Reason")}
+		case res.StatusCode >= 500:
+			err = fmt.Errorf("webhook: status %d", res.StatusCode)
+			continue
+		case res.StatusCode >= 300:
+			return nil, fmt.Errorf("webhook: status %d", res.StatusCode)
+		}
+		return answer, nil
+	}
+	return nil, err
+}
+
+func (w *webhook) post(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	if w.options.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(headerTimestamp, timestamp)
+		req.Header.Set(headerSignature, "sha256="+sign(w.options.Secret, timestamp, body))
+	}
+	return w.client.Do(req)
+}
+
+// sign returns the hex HMAC-SHA256 of timestamp.body, the timestamp keeps
+// signatures from being replayed later on.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = io.WriteString(mac, timestamp+".")
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,166 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package serv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"eventsourced/intern/broker"
+	"eventsourced/intern/event"
+	"eventsourced/intern/metric"
+	"eventsourced/intern/mock/serv"
+
+	"github.com/golang/mock/gomock"
+)
+
+// Must allow, deny and override queues by the answer of the webhook
+func TestWebhook_Authorize(t *testing.T) {
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		body, _ := io.ReadAll(r.Body)
+
+		timestamp := r.Header.Get(headerTimestamp)
+		if r.Header.Get(headerSignature) != "sha256="+sign("secret", timestamp, body) {
+			t.Errorf("unexpected signature %q", r.Header.Get(headerSignature))
+		}
+		var e PresenceEvent
+		_ = json.Unmarshal(body, &e)
+		if e.Type != "authorize" || e.Instance != "i-1" {
+			t.Errorf("unexpected event %+v", e)
+		}
+
+		switch e.Queue {
+		case "allow":
+		case "override":
+			_, _ = io.WriteString(w, `{"allow":true,"queue":"user-1"}`)
+		case "reserved":
+			_, _ = io.WriteString(w, `{"allow":true,"queue":"amq.user-1"}`)
+		case "deny":
+			_, _ = io.WriteString(w, `{"allow":false,"reason":"logged out"}`)
+		case "forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "flaky":
+			if atomic.LoadInt32(&calls)%2 == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	hook := NewWebhook(WebhookOptions{
+		Authorize: srv.URL,
+		Secret:    "secret",
+		Timeout:   time.Second,
+		Retries:   1,
+		Instance:  "i-1",
+	})
+	defer func() { _ = hook.Close() }()
+
+	samples := []struct {
+		queue  string
+		expect string
+		err    error
+		calls  int32
+	}{
+		{queue: "allow", expect: "allow", calls: 1},
+		{queue: "override", expect: "user-1", calls: 1},
+		{queue: "reserved", err: errQueueName, calls: 1},
+		{queue: "deny", err: &DeniedError{Reason: "logged out"}, calls: 1},
+		{queue: "forbidden", err: &DeniedError{}, calls: 1},
+		{queue: "flaky", expect: "flaky", calls: 2},
+		{queue: "broken", err: errors.New("webhook: status 500"), calls: 2},
+	}
+
+	for _, sample := range samples {
+		atomic.StoreInt32(&calls, 0)
+		queue, err := hook.Authorize(context.Background(), PresenceEvent{Queue: sample.queue})
+
+		if queue != sample.expect {
+			t.Errorf("%s: expected queue %q, got %q", sample.queue, sample.expect, queue)
+		}
+		if (err == nil) != (sample.err == nil) || err != nil && err.Error() != sample.err.Error() {
+			t.Errorf("%s: expected error %v, got %v", sample.queue, sample.err, err)
+		}
+		if n := atomic.LoadInt32(&calls); n != sample.calls {
+			t.Errorf("%s: expected %d calls, got %d", sample.queue, sample.calls, n)
+		}
+	}
+
+	if queue, err := NewWebhook(WebhookOptions{}).Authorize(context.Background(), PresenceEvent{Queue: "q"}); queue != "q" || err != nil {
+		t.Errorf("expected queue to be allowed without webhook, got %q, %v", queue, err)
+	}
+}
+
+// Must authorize the stream and call the closed webhook
+func TestWebhook_Handle(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	closed := make(chan PresenceEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e PresenceEvent
+		_ = json.NewDecoder(r.Body).Decode(&e)
+
+		switch {
+		case r.URL.Path == "/closed":
+			closed <- e
+		case e.Claims["user"] == "1":
+			_, _ = io.WriteString(w, `{"allow":true,"queue":"user-1"}`)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	hook := NewWebhook(WebhookOptions{Authorize: srv.URL + "/authorize", Closed: srv.URL + "/closed", Timeout: time.Second})
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+	messages := make(chan broker.Message)
+	close(messages)
+
+	c := mock_serv.NewMockConsumer(ctrl)
+	c.EXPECT().Consume("user-1", gomock.Any()).Return((<-chan broker.Message)(messages), nil)
+	c.EXPECT().Notify(gomock.Any())
+	c.EXPECT().Ignore(gomock.Any())
+
+	for user, status := range map[string]int{"2": http.StatusForbidden, "1": http.StatusOK} {
+		h := NewServerSentHandler(
+			c,
+			NewPattern("q"),
+			event.NewProducer(),
+			&ResponseHeader{},
+			metric.NewMetric("test"),
+			&StreamOptions{Webhook: hook, Claims: Claims{"user": "${header:X-User}"}, Logger: logger},
+		)
+		recorder := httptest.NewRecorder()
+		h.Handle(recorder, &http.Request{Method: "GET", Header: http.Header{"X-User": []string{user}}})
+
+		if recorder.Code != status {
+			t.Errorf("user %s: expected status %d, got %d", user, status, recorder.Code)
+		}
+	}
+	_ = hook.Close()
+
+	select {
+	case e := <-closed:
+		if e.Type != "disconnected" || e.Queue != "user-1" || e.Reason != reasonBroker || e.Disconnected == nil {
+			t.Errorf("unexpected event %+v", e)
+		}
+	default:
+		t.Error("expected closed webhook to be called")
+	}
+}
@@ -0,0 +1,92 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package tracing
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"eventsourced/intern/conf"
+)
+
+type (
+	// Provider yields the tracer spans are started with.
+	Provider interface {
+		Tracer() trace.Tracer
+		Shutdown() error
+	}
+	provider struct {
+		tracer   trace.Tracer
+		shutdown func(context.Context) error
+	}
+)
+
+// instrumentation names the tracer of the spans created by eventsourced.
+const instrumentation = "eventsourced"
+
+// shutdownTimeout bounds the export of remaining spans on shutdown.
+const shutdownTimeout = 5 * time.Second
+
+// NewProvider exports spans via OTLP over HTTP to the configured endpoint,
+// e.g. http://collector:4318, tracing is disabled without endpoint.
+func NewProvider(config conf.Tracing, version string) (Provider, error) {
+	if config.Endpoint == "" {
+		return NewNoopProvider(), nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(config.Endpoint)}
+	if u, err := url.Parse(config.Endpoint); err == nil && strings.Trim(u.Path, "/") == "" {
+		options = append(options, otlptracehttp.WithURLPath("/v1/traces"))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewExporterProvider(sdktrace.NewBatchSpanProcessor(exporter), config, version), nil
+}
+
+// NewExporterProvider creates a provider for the given span processor, a
+// tracetest.InMemoryExporter wrapped by sdktrace.NewSimpleSpanProcessor
+// collects the spans in tests.
+func NewExporterProvider(processor sdktrace.SpanProcessor, config conf.Tracing, version string) Provider {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Sample))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", config.Service),
+			attribute.String("service.version", version),
+		)),
+	)
+	return &provider{tracer: tp.Tracer(instrumentation), shutdown: tp.Shutdown}
+}
+
+// NewNoopProvider creates a provider of spans recording nothing.
+func NewNoopProvider() Provider {
+	return &provider{tracer: noop.NewTracerProvider().Tracer(instrumentation)}
+}
+
+// Tracer ...
+func (p *provider) Tracer() trace.Tracer {
+	return p.tracer
+}
+
+// Shutdown exports the remaining spans.
+func (p *provider) Shutdown() error {
+	if p.shutdown == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return p.shutdown(ctx)
+}
@@ -0,0 +1,81 @@
+// MIT license · Daniel T. Gorski · dtg [at] lengo [dot] org · 03/2019
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"eventsourced/intern/conf"
+)
+
+// Must not record spans without endpoint
+func TestNewProvider_Noop(t *testing.T) {
+	p, err := NewProvider(conf.Tracing{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := p.Tracer().Start(context.Background(), "test")
+	if span.IsRecording() {
+		t.Error("unexpected recording span")
+	}
+	if err := p.Shutdown(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Must export spans via OTLP over HTTP on shutdown
+func TestNewProvider_OTLP(t *testing.T) {
+	var exported int32
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" && r.Header.Get("Content-Type") == "application/x-protobuf" {
+			atomic.AddInt32(&exported, 1)
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	p, err := NewProvider(conf.Tracing{Endpoint: collector.URL, Service: "test", Sample: 1}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := p.Tracer().Start(context.Background(), "test")
+	span.End()
+
+	if err := p.Shutdown(); err != nil {
+		t.Error(err)
+	}
+	if atomic.LoadInt32(&exported) != 1 {
+		t.Errorf("expected export, got %d", exported)
+	}
+}
+
+// Must sample by ratio and name the service
+func TestNewExporterProvider(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	config := conf.Tracing{Service: "test", Sample: 0}
+
+	p := NewExporterProvider(sdktrace.NewSimpleSpanProcessor(exporter), config, "1.0")
+	_, span := p.Tracer().Start(context.Background(), "dropped")
+	span.End()
+
+	config.Sample = 1
+	p = NewExporterProvider(sdktrace.NewSimpleSpanProcessor(exporter), config, "1.0")
+	_, span = p.Tracer().Start(context.Background(), "sampled")
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "sampled" {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	if name, _ := spans[0].Resource.Set().Value("service.name"); name.AsString() != "test" {
+		t.Errorf("unexpected service %s", name.AsString())
+	}
+}